@@ -0,0 +1,97 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Validate, show and edit the Alpamon configuration",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// Only warnings, e.g. about turned off SSL verification, are of interest here.
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:          "validate [path]",
+	Short:        "Check the configuration, or only the file at path, and print every problem found",
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if len(args) > 0 {
+			err = config.ValidateFile(args[0])
+		} else {
+			config.SetCommandLine(configFile, configOverrides)
+			_, err = config.ReadConfig()
+		}
+		if err != nil {
+			return printProblems(err)
+		}
+
+		fmt.Println("Config is valid.")
+		return nil
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:          "show",
+	Short:        "Print the effective configuration, with secrets redacted",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.SetCommandLine(configFile, configOverrides)
+
+		settings, err := config.ReadConfig()
+		if err != nil {
+			return printProblems(err)
+		}
+
+		_, err = config.Dump(settings).WriteTo(os.Stdout)
+		return err
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:          "set section.key value",
+	Short:        "Change a value in the config file that sets it",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.SetCommandLine(configFile, configOverrides)
+
+		path, err := config.Set(args[0], args[1])
+		if err != nil {
+			return printProblems(err)
+		}
+
+		fmt.Printf("Set %s in %s. Run `systemctl reload alpamon` to apply it.\n", args[0], path)
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd, configShowCmd, configSetCmd)
+}
+
+// printProblems lists the problems of an invalid configuration one per line,
+// and returns err for cobra to report.
+func printProblems(err error) error {
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		for _, problem := range invalid.Problems {
+			_, _ = fmt.Fprintf(os.Stderr, "- %s\n", problem)
+		}
+		return errors.New("config is invalid")
+	}
+	return err
+}
@@ -1,6 +1,11 @@
 package command
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
 	"github.com/alpacanetworks/alpamon-go/pkg/logger"
 	"github.com/alpacanetworks/alpamon-go/pkg/runner"
 	"github.com/spf13/cobra"
@@ -18,6 +23,12 @@ var ftpCmd = &cobra.Command{
 			Logger:        logger.NewFtpLogger(),
 		}
 
+		// alpamon passes the worker settings on stdin, see runner.openFtp.
+		err := json.NewDecoder(os.Stdin).Decode(&data.Options)
+		if err != nil && !errors.Is(err, io.EOF) {
+			data.Logger.Debug().Err(err).Msg("Failed to read worker options from stdin")
+		}
+
 		RunFtpWorker(data)
 	},
 }
@@ -14,6 +14,10 @@ import (
 const (
 	configTemplatePath = "configs/alpamon.conf"
 	configTarget       = "/etc/alpamon/alpamon.conf"
+	keyFileTarget      = "/etc/alpamon/alpamon.key"
+	// registrationTarget keeps the credentials of an enrolled server until
+	// register has installed alpamon with them.
+	registrationTarget = "/etc/alpamon/registration.env"
 
 	tmpFilePath   = "configs/tmpfile.conf"
 	tmpFileTarget = "/usr/lib/tmpfiles.d/alpamon.conf"
@@ -23,12 +27,16 @@ const (
 )
 
 type ConfigData struct {
-	URL    string
-	ID     string
-	Key    string
-	Verify string
-	CACert string
-	Debug  string
+	URL        string
+	ID         string
+	Key        string
+	KeyFile    string
+	Verify     string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	Pins       string
+	Debug      string
 }
 
 //go:embed configs/*
@@ -40,22 +48,7 @@ var installCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Running Alpamon install command...")
 
-		err := copyEmbeddedFile(tmpFilePath, tmpFileTarget)
-		if err != nil {
-			return err
-		}
-
-		output, err := exec.Command("systemd-tmpfiles", "--create").CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("%w\n%s", err, string(output))
-		}
-
-		err = writeConfig()
-		if err != nil {
-			return err
-		}
-
-		err = writeService()
+		err := install(configDataFromEnv())
 		if err != nil {
 			return err
 		}
@@ -65,7 +58,40 @@ var installCmd = &cobra.Command{
 	},
 }
 
-func writeConfig() error {
+func install(configData ConfigData) error {
+	err := copyEmbeddedFile(tmpFilePath, tmpFileTarget)
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("systemd-tmpfiles", "--create").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, string(output))
+	}
+
+	err = writeConfig(configData)
+	if err != nil {
+		return err
+	}
+
+	return writeService()
+}
+
+func configDataFromEnv() ConfigData {
+	return ConfigData{
+		URL:        utils.GetEnvOrDefault("ALPACON_URL", ""),
+		ID:         utils.GetEnvOrDefault("PLUGIN_ID", ""),
+		Key:        utils.GetEnvOrDefault("PLUGIN_KEY", ""),
+		Verify:     utils.GetEnvOrDefault("ALPACON_SSL_VERIFY", "true"),
+		CACert:     utils.GetEnvOrDefault("ALPACON_CA_CERT", ""),
+		ClientCert: utils.GetEnvOrDefault("ALPACON_CLIENT_CERT", ""),
+		ClientKey:  utils.GetEnvOrDefault("ALPACON_CLIENT_KEY", ""),
+		Pins:       utils.GetEnvOrDefault("ALPACON_SSL_PINS", ""),
+		Debug:      utils.GetEnvOrDefault("PLUGIN_DEBUG", "true"),
+	}
+}
+
+func writeConfig(configData ConfigData) error {
 	if isConfigValid(configTarget) {
 		return nil
 	}
@@ -80,19 +106,21 @@ func writeConfig() error {
 		return fmt.Errorf("failed to parse template: %v", err)
 	}
 
-	configData := ConfigData{
-		URL:    utils.GetEnvOrDefault("ALPACON_URL", ""),
-		ID:     utils.GetEnvOrDefault("PLUGIN_ID", ""),
-		Key:    utils.GetEnvOrDefault("PLUGIN_KEY", ""),
-		Verify: utils.GetEnvOrDefault("ALPACON_SSL_VERIFY", "true"),
-		CACert: utils.GetEnvOrDefault("ALPACON_CA_CERT", ""),
-		Debug:  utils.GetEnvOrDefault("PLUGIN_DEBUG", "true"),
-	}
-
 	if configData.URL == "" || configData.ID == "" || configData.Key == "" {
 		return fmt.Errorf("environment variables ALPACON_URL, PLUGIN_ID, PLUGIN_KEY must be set")
 	}
 
+	// The key is kept out of the config, in a file that only root can read.
+	err = os.MkdirAll(filepath.Dir(keyFileTarget), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	err = os.WriteFile(keyFileTarget, []byte(configData.Key+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write key file: %v", err)
+	}
+	configData.KeyFile = keyFileTarget
+
 	tmpFile, err := os.CreateTemp("", "alpamon.conf")
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %v", err)
@@ -123,7 +151,30 @@ func writeService() error {
 		return nil
 	}
 
-	err := copyEmbeddedFile(serviceTemplatePath, serviceTarget)
+	tmplData, err := configFiles.ReadFile(serviceTemplatePath)
+	if err != nil {
+		return fmt.Errorf("failed to read template file (%s): %v", serviceTemplatePath, err)
+	}
+
+	tmpl, err := template.New("alpamon.service").Parse(string(tmplData))
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	// Pass the key as a systemd credential only if install wrote it apart,
+	// systemd refuses to start the service if the file is missing.
+	serviceData := struct{ KeyFile string }{}
+	if isConfigValid(keyFileTarget) {
+		serviceData.KeyFile = keyFileTarget
+	}
+
+	outFile, err := os.Create(serviceTarget)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %v", err)
+	}
+	defer func() { _ = outFile.Close() }()
+
+	err = tmpl.Execute(outFile, serviceData)
 	if err != nil {
 		return fmt.Errorf("failed to write target file: %v", err)
 	}
@@ -0,0 +1,177 @@
+package command
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alpacanetworks/alpamon-go/pkg/runner"
+	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
+	"github.com/alpacanetworks/alpamon-go/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	registerToken string
+	registerURL   string
+)
+
+var registerCmd = &cobra.Command{
+	Use:   "register --token <token>",
+	Short: "Register this server to Alpacon with a one-time token and start Alpamon",
+	Long: "Register this server to Alpacon with a one-time token and start Alpamon.\n" +
+		"The Alpacon URL and SSL options are read from the same environment variables as install.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if isConfigValid(configTarget) {
+			return fmt.Errorf("%s already exists, this server is already registered", configTarget)
+		}
+
+		configData := configDataFromEnv()
+		if registerURL != "" {
+			configData.URL = registerURL
+		}
+		if configData.URL == "" {
+			return fmt.Errorf("the Alpacon URL must be given with --url or ALPACON_URL")
+		}
+		configData.URL = strings.TrimSuffix(configData.URL, "/")
+
+		transport, err := enrollmentTransport(configData)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Registering this server to %s...\n", configData.URL)
+		utils.InitPlatform()
+		configData.ID, configData.Key, err = runner.Enroll(configData.URL, registerToken, transport)
+		if err != nil {
+			return err
+		}
+		// The token is spent now, so from here on a failure must not lose
+		// the key. It is kept where only root can read it, never printed.
+		err = saveRegistration(registrationTarget, configData)
+		if err != nil {
+			return fmt.Errorf("registered this server as %s, but failed to save its key: %w", configData.ID, err)
+		}
+		fmt.Printf("Registered this server as %s.\n", configData.ID)
+
+		err = install(configData)
+		if err == nil {
+			err = startService()
+		}
+		if err != nil {
+			return finishRegistrationError(registrationTarget, err)
+		}
+		_ = os.Remove(registrationTarget)
+
+		fmt.Printf("Alpamon has been registered as server %s and started.\n", configData.ID)
+		return nil
+	},
+}
+
+// saveRegistration writes the settings of an enrolled server to path, in
+// the environment variables read by install, readable by root only.
+func saveRegistration(path string, configData ConfigData) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	// An existing file keeps its mode on open.
+	err = file.Chmod(0600)
+	if err != nil {
+		return err
+	}
+
+	for _, variable := range []struct{ name, value string }{
+		{"ALPACON_URL", configData.URL},
+		{"PLUGIN_ID", configData.ID},
+		{"PLUGIN_KEY", configData.Key},
+		{"ALPACON_SSL_VERIFY", configData.Verify},
+		{"ALPACON_CA_CERT", configData.CACert},
+		{"ALPACON_CLIENT_CERT", configData.ClientCert},
+		{"ALPACON_CLIENT_KEY", configData.ClientKey},
+		{"ALPACON_SSL_PINS", configData.Pins},
+		{"PLUGIN_DEBUG", configData.Debug},
+	} {
+		_, err = fmt.Fprintf(file, "%s='%s'\n", variable.name, strings.ReplaceAll(variable.value, "'", `'\''`))
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// finishRegistrationError tells how to finish a registration that failed
+// after the server was enrolled, as the token cannot be used again. The
+// credentials stay in path, which the message only refers to.
+func finishRegistrationError(path string, err error) error {
+	return fmt.Errorf("%w\n\nThe server was registered but Alpamon could not be installed. "+
+		"Its credentials are saved in %s. Fix the problem above and finish with:\n\n"+
+		"  sudo sh -c 'set -a && . %s && alpamon install && systemctl daemon-reload && systemctl enable --now alpamon.service'\n",
+		err, path, path)
+}
+
+func init() {
+	registerCmd.Flags().StringVar(&registerToken, "token", "", "one-time registration token issued by Alpacon")
+	registerCmd.Flags().StringVar(&registerURL, "url", "", "Alpacon URL (default $ALPACON_URL)")
+	_ = registerCmd.MarkFlagRequired("token")
+}
+
+// enrollmentTransport connects to Alpacon with the SSL options that will be
+// written to the config, before any config exists.
+func enrollmentTransport(configData ConfigData) (http.RoundTripper, error) {
+	tlsOptions := scheduler.TLSOptions{Verify: configData.Verify != "false"}
+
+	var err error
+	if configData.CACert != "" {
+		if tlsOptions.CaCert, err = os.ReadFile(configData.CACert); err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+	}
+	if configData.ClientCert != "" {
+		if tlsOptions.ClientCert, err = os.ReadFile(configData.ClientCert); err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		if tlsOptions.ClientKey, err = os.ReadFile(configData.ClientKey); err != nil {
+			return nil, fmt.Errorf("failed to read client key: %w", err)
+		}
+	}
+	if configData.Pins != "" {
+		for _, pin := range strings.Split(configData.Pins, ",") {
+			tlsOptions.Pins = append(tlsOptions.Pins, strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		}
+	}
+
+	tlsConfig, err := tlsOptions.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = scheduler.ProxyOptions{}.ProxyFunc()
+	return transport, nil
+}
+
+func startService() error {
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", "--now", "alpamon.service"},
+	} {
+		output, err := exec.Command("systemctl", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w\n%s", err, string(output))
+		}
+	}
+	return nil
+}
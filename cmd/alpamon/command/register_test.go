@@ -0,0 +1,30 @@
+package command
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedRegistrationKeepsKeyOutOfOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alpamon", "registration.env")
+	configData := ConfigData{URL: "https://alpacon.example.com", ID: "7a1bd5a4", Key: "it's-secret", Verify: "true"}
+
+	require.NoError(t, saveRegistration(path, configData))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "The key must be readable by root only.")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `PLUGIN_KEY='it'\''s-secret'`)
+	assert.Contains(t, string(content), "PLUGIN_ID='7a1bd5a4'")
+
+	err = finishRegistrationError(path, errors.New("systemd-tmpfiles failed"))
+	assert.NotContains(t, err.Error(), configData.Key)
+	assert.Contains(t, err.Error(), path)
+}
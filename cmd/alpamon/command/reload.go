@@ -0,0 +1,90 @@
+package command
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/alpacanetworks/alpamon-go/pkg/runner"
+	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadOnHangup reloads the config for every signal received on hangup,
+// until ctx is done.
+func reloadOnHangup(ctx context.Context, hangup <-chan os.Signal, session *scheduler.Session, wsClient *runner.WebsocketClient) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			reloadConfig(session, wsClient)
+		}
+	}
+}
+
+// reloadConfig reads the config again and applies what changed. Settings
+// used to connect to Alpacon take effect on new connections, and the
+// backhaul reconnects to pick them up. Open pty sessions are left alone.
+// If the config is invalid, the current settings are kept.
+func reloadConfig(session *scheduler.Session, wsClient *runner.WebsocketClient) {
+	log.Info().Msg("Reloading config...")
+
+	settings, err := config.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload config, keeping the current settings.")
+		return
+	}
+
+	previous := *config.GlobalSettings()
+
+	// Reporters are started once, so their number only changes on restart.
+	var restart []string
+	if settings.HTTPThreads != previous.HTTPThreads {
+		restart = append(restart, "tuning.http_threads")
+		settings.HTTPThreads = previous.HTTPThreads
+	}
+
+	changed := config.Changed(previous, settings)
+	if len(changed) > 0 {
+		config.InitSettings(settings)
+		err = scheduler.ApplySettings(session)
+		if err != nil {
+			config.InitSettings(previous)
+			log.Error().Err(err).Msg("Failed to apply the reloaded config, keeping the current settings.")
+			return
+		}
+		config.SetLogLevel(settings.Debug)
+		log.Info().Msgf("Applied config changes to %s.", strings.Join(changed, ", "))
+
+		if needsReconnect(changed) {
+			log.Info().Msg("Reconnecting backhaul with the new settings.")
+			wsClient.Reconnect()
+		}
+	} else if len(restart) == 0 {
+		log.Info().Msg("Config is unchanged.")
+	}
+
+	if len(restart) > 0 {
+		log.Warn().Msgf("Changes to %s take effect when alpamon is restarted.", strings.Join(restart, ", "))
+	}
+}
+
+// keepAliveKeys are set for the backhaul connection when it is established.
+var keepAliveKeys = []string{"tuning.ping_interval", "tuning.pong_timeout"}
+
+// needsReconnect reports whether any of the changed keys is used to
+// establish the backhaul connection or to keep it alive.
+func needsReconnect(changed []string) bool {
+	for _, key := range changed {
+		if strings.HasPrefix(key, "server.") || strings.HasPrefix(key, "ssl.") || strings.HasPrefix(key, "proxy.") {
+			return true
+		}
+		if slices.Contains(keepAliveKeys, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeedsReconnect(t *testing.T) {
+	assert.True(t, needsReconnect([]string{"logging.debug", "server.url"}))
+	assert.True(t, needsReconnect([]string{"tuning.ping_interval"}), "The backhaul keepalive is set when it connects.")
+	assert.True(t, needsReconnect([]string{"tuning.pong_timeout"}))
+	assert.False(t, needsReconnect([]string{"logging.debug", "tuning.retry_limit"}))
+}
@@ -1,10 +1,13 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"github.com/alpacanetworks/alpamon-go/pkg/version"
 	"os"
+	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/alpacanetworks/alpamon-go/pkg/config"
 	"github.com/alpacanetworks/alpamon-go/pkg/logger"
@@ -16,6 +19,12 @@ import (
 	"github.com/spf13/cobra"
 )
 
+const (
+	commandDrainTimeout = 30 * time.Second
+	sessionCloseTimeout = 5 * time.Second
+	queueFlushTimeout   = 10 * time.Second
+)
+
 var RootCmd = &cobra.Command{
 	Use:   "alpamon",
 	Short: "Secure Server Agent for Alpacon",
@@ -24,8 +33,15 @@ var RootCmd = &cobra.Command{
 	},
 }
 
+var (
+	configFile      string
+	configOverrides []string
+)
+
 func init() {
-	RootCmd.AddCommand(installCmd, ftpCmd)
+	RootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file to use instead of /etc/alpamon/alpamon.conf or ~/.alpamon.conf")
+	RootCmd.PersistentFlags().StringArrayVar(&configOverrides, "set", nil, "override a config value, e.g. --set logging.debug=true (repeatable)")
+	RootCmd.AddCommand(installCmd, registerCmd, configCmd, ftpCmd)
 }
 
 func runAgent() {
@@ -42,8 +58,22 @@ func runAgent() {
 
 	fmt.Printf("alpamon version %s starting.\n", version.Version)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// SIGHUP reloads the config instead of terminating alpamon.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
 	// Config & Settings
-	settings := config.LoadConfig()
+	config.SetCommandLine(configFile, configOverrides)
+	settings, err := config.LoadConfig()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to load config:", err.Error())
+		_ = os.Remove(pidFilePath)
+		os.Exit(1)
+	}
 	config.InitSettings(settings)
 
 	// Session
@@ -62,9 +92,14 @@ func runAgent() {
 	runner.CommitAsync(session, commissioned)
 
 	// Websocket Client
-	wsClient := runner.NewWebsocketClient(session)
+	wsClient := runner.NewWebsocketClient(ctx, session)
+	go reloadOnHangup(ctx, hangup, session, wsClient)
 	wsClient.RunForever()
 
+	// From now on, a second signal terminates alpamon right away.
+	stop()
+	shutdown(wsClient)
+
 	if wsClient.RestartRequested {
 		if err = os.Remove(pidFilePath); err != nil {
 			log.Error().Err(err).Msg("Failed to remove PID file")
@@ -87,3 +122,16 @@ func runAgent() {
 
 	log.Debug().Msg("Bye.")
 }
+
+// shutdown waits for running commands to report their results, closes the
+// pty and ftp sessions, then flushes the request queue.
+func shutdown(wsClient *runner.WebsocketClient) {
+	log.Info().Msg("Shutting down alpamon...")
+
+	if !wsClient.WaitForCommands(commandDrainTimeout) {
+		log.Warn().Msgf("Some commands are still running after %s, their results will not be reported.", commandDrainTimeout)
+	}
+	runner.CloseTerminals(sessionCloseTimeout)
+	runner.StopFtpWorkers(sessionCloseTimeout)
+	scheduler.StopReporters(queueFlushTimeout)
+}
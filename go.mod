@@ -3,7 +3,6 @@ module github.com/alpacanetworks/alpamon-go
 go 1.22.5
 
 require (
-	github.com/adrianbrad/queue v1.3.0
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/creack/pty v1.1.23
 	github.com/glebarez/go-sqlite v1.20.3
@@ -14,6 +13,7 @@ require (
 	github.com/shirou/gopsutil/v4 v4.24.8
 	github.com/spf13/cobra v1.8.1
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/sys v0.24.0
 	gopkg.in/go-playground/validator.v9 v9.31.0
 	gopkg.in/ini.v1 v1.67.0
 )
@@ -37,7 +37,6 @@ require (
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/sys v0.24.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -1,10 +1,19 @@
 package config
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,87 +27,292 @@ var (
 		filepath.Join(os.Getenv("HOME"), ".alpamon.conf"),
 	}
 
-	GlobalSettings Settings
+	// globalSettings holds the settings in effect. A reload replaces them
+	// as a whole, so readers never see a half-updated value.
+	globalSettings atomic.Pointer[Settings]
+	// settingsMu serializes the writers of globalSettings.
+	settingsMu sync.Mutex
 )
 
 const (
-	wsPath             = "/ws/servers/backhaul/"
-	MinConnectInterval = 5 * time.Second
-	MaxConnectInterval = 300 * time.Second
+	wsPath = "/ws/servers/backhaul/"
+
+	defaultHTTPThreads        = 4
+	defaultMaxQueueSize       = 10 * 60 * 60 // 10 entries/second * 1h
+	defaultRetryLimit         = 5
+	defaultRequestTimeout     = 5 * time.Second
+	defaultPingInterval       = 30 * time.Second
+	defaultPongTimeout        = 10 * time.Second
+	defaultMinConnectInterval = 5 * time.Second
+	defaultMaxConnectInterval = 60 * time.Second
+	defaultUserMgmtTimeout    = 60 * time.Second
+	defaultFtpMaxListDepth    = 3
+	defaultCommandWorkers     = 8
+	defaultCommandBacklog     = 100
+	defaultCommandOutputLimit = 1024 * 1024
+	defaultCommandStreamLimit = 16 * 1024 * 1024
+	defaultGzipMinSize        = 64 * 1024
 )
 
 func InitSettings(settings Settings) {
-	GlobalSettings = settings
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	globalSettings.Store(&settings)
 }
 
-func LoadConfig() Settings {
-	var iniData *ini.File
-	var err error
-	var validConfigFile string
+// GlobalSettings returns the settings in effect. They must not be modified;
+// use InitSettings or UpdateSettings instead. A caller reading several
+// fields should keep the returned pointer, so they all come from the same
+// settings even if a reload happens meanwhile.
+func GlobalSettings() *Settings {
+	if settings := globalSettings.Load(); settings != nil {
+		return settings
+	}
+	return &Settings{}
+}
 
-	for _, configFile := range configFiles {
-		fileInfo, statErr := os.Stat(configFile)
-		if statErr != nil {
-			if os.IsNotExist(statErr) {
-				continue
-			} else {
-				log.Error().Err(statErr).Msgf("Error accessing config file %s", configFile)
-				continue
-			}
-		}
+// UpdateSettings replaces the settings in effect with a copy changed by update.
+func UpdateSettings(update func(settings *Settings)) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
 
-		if fileInfo.Size() == 0 {
-			log.Debug().Msgf("Config file %s is empty, skipping...", configFile)
-			continue
-		}
+	settings := *GlobalSettings()
+	update(&settings)
+	globalSettings.Store(&settings)
+}
 
-		log.Debug().Msgf("Using config file %s", configFile)
-		validConfigFile = configFile
-		break
+// LoadConfig reads the configuration and sets the log level accordingly.
+func LoadConfig() (Settings, error) {
+	settings, err := ReadConfig()
+	if err != nil {
+		return Settings{}, err
 	}
 
-	if validConfigFile == "" {
-		log.Fatal().Msg("No valid config file found")
+	SetLogLevel(settings.Debug)
+
+	return settings, nil
+}
+
+// ReadConfig loads and validates the configuration without applying any of
+// it, so that a running alpamon can keep its current settings when a
+// reloaded configuration is invalid. The file it was loaded from, which
+// UpdateKey writes a rotated key to, comes along with the settings and only
+// takes effect once they are applied. Problems found by the validation are
+// returned as a *ValidationError.
+func ReadConfig() (Settings, error) {
+	validConfigFile := findBaseConfigFile()
+
+	iniData, sources, err := loadLayers(validConfigFile)
+	if err != nil {
+		return Settings{}, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	iniData, err = ini.Load(validConfigFile)
+	settings, err := parseConfig(iniData)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to load config file %s", validConfigFile)
+		return Settings{}, err
 	}
 
+	settings.configFile = validConfigFile
+	settings.sources = sources
+
+	return settings, nil
+}
+
+// ValidateFile checks the config file at path on its own, without the
+// drop-ins, ALPAMON_* variables and --set flags that ReadConfig merges
+// over it.
+func ValidateFile(path string) error {
+	iniData, err := ini.Load(path)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", path, err)
+	}
+
+	_, err = parseConfig(iniData)
+	return err
+}
+
+func parseConfig(iniData *ini.File) (Settings, error) {
 	var config Config
-	err = iniData.MapTo(&config)
+	err := iniData.StrictMapTo(&config)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to parse config file %s", validConfigFile)
+		return Settings{}, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	settings, problems := validateConfig(config)
+	if len(problems) > 0 {
+		return Settings{}, &ValidationError{Problems: problems}
 	}
 
-	if config.Logging.Debug {
+	return settings, nil
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "config is invalid: " + strings.Join(e.Problems, "; ")
+}
+
+// SetLogLevel enables debug logs or restricts logs to info and above.
+func SetLogLevel(debug bool) {
+	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
+}
+
+// UpdateKey replaces the server key in the key file, or else in the config
+// file it was loaded from. A key passed only as a systemd credential cannot
+// be replaced.
+func UpdateKey(key string) error {
+	settings := GlobalSettings()
+	if settings.KeyFile != "" {
+		return writeFileAtomic(settings.KeyFile, func(w io.Writer) error {
+			_, err := fmt.Fprintln(w, key)
+			return err
+		})
+	}
+	if _, ok := settings.sources["server.key"]; !ok && credentialKeyFile() != "" {
+		return fmt.Errorf("server key is passed as the %s credential, set server.key_file to the file it is loaded from", keyCredential)
+	}
 
-	isValid, settings := validateConfig(config)
+	path, ok := settings.sources["server.key"]
+	if !ok {
+		path = settings.configFile
+	}
+	if path == "" {
+		return errors.New("no config file has been loaded")
+	}
+	if !isFileSource(path) {
+		return fmt.Errorf("server.key is set by %s and cannot be rewritten", path)
+	}
 
-	if !isValid {
-		log.Fatal().Msg("Aborting...")
+	return updateConfigFile(path, func(iniData *ini.File) {
+		iniData.Section("server").Key("key").SetValue(key)
+	})
+}
+
+// updateConfigFile applies update to the config file at path and writes it
+// back with writeFileAtomic. A missing file is created.
+func updateConfigFile(path string, update func(*ini.File)) error {
+	iniData := ini.Empty()
+	if _, err := os.Stat(path); err == nil {
+		iniData, err = ini.Load(path)
+		if err != nil {
+			return fmt.Errorf("failed to load config file %s: %w", path, err)
+		}
 	}
+	update(iniData)
 
-	return settings
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := iniData.WriteTo(w)
+		return err
+	})
 }
 
-func validateConfig(config Config) (bool, Settings) {
+// writeFileAtomic replaces the file at path with what write produces, so
+// that a crash never leaves a truncated file behind. The file keeps its mode
+// and owner. A missing file is created readable by its owner only, as config
+// and key files hold the server key.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	mode := os.FileMode(0600)
+	owner := -1
+	group := -1
+
+	fileInfo, err := os.Stat(path)
+	if err == nil {
+		mode = fileInfo.Mode().Perm()
+		if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+			owner, group = int(stat.Uid), int(stat.Gid)
+		}
+	} else if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	} else {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+
+	err = write(tmpFile)
+	if err == nil {
+		err = tmpFile.Chmod(mode)
+	}
+	if err == nil && owner >= 0 {
+		err = tmpFile.Chown(owner, group)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// parsePins parses a comma-separated list of SPKI SHA-256 pins, given in
+// base64 with an optional "sha256/" prefix as printed by common tools.
+func parsePins(value string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%q is not a base64-encoded SHA-256 digest", pin)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// validateConfig builds the settings out of config. It returns every
+// problem found, so that they can all be fixed at once.
+func validateConfig(config Config) (Settings, []string) {
 	log.Debug().Msg("Validating configuration fields...")
 
 	settings := Settings{
-		WSPath:      wsPath,
-		UseSSL:      false,
-		SSLVerify:   true,
-		SSLOpt:      make(map[string]interface{}),
-		HTTPThreads: 4,
+		WSPath:       wsPath,
+		UseSSL:       false,
+		SSLVerify:    true,
+		SSLOpt:       make(map[string]interface{}),
+		HTTPThreads:  defaultHTTPThreads,
+		MaxQueueSize: defaultMaxQueueSize,
+		RetryLimit:   defaultRetryLimit,
+		GzipMinSize:  defaultGzipMinSize,
+
+		RequestTimeout:     defaultRequestTimeout,
+		PingInterval:       defaultPingInterval,
+		PongTimeout:        defaultPongTimeout,
+		MinConnectInterval: defaultMinConnectInterval,
+		MaxConnectInterval: defaultMaxConnectInterval,
+		UserMgmtTimeout:    defaultUserMgmtTimeout,
+		FtpMaxListDepth:    defaultFtpMaxListDepth,
+		CommandWorkers:     defaultCommandWorkers,
+		CommandBacklog:     defaultCommandBacklog,
+		CommandOutputLimit: defaultCommandOutputLimit,
+		CommandStreamLimit: defaultCommandStreamLimit,
 	}
 
-	valid := true
+	settings.Debug = config.Logging.Debug
+
+	var problems []string
 	val := config.Server.URL
 	if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
 		val = strings.TrimSuffix(val, "/")
@@ -106,16 +320,20 @@ func validateConfig(config Config) (bool, Settings) {
 		settings.WSPath = strings.Replace(val, "http", "ws", 1) + settings.WSPath
 		settings.UseSSL = strings.HasPrefix(val, "https://")
 	} else {
-		log.Error().Msg("Server url is invalid")
-		valid = false
+		problems = append(problems, "Server url is invalid")
 	}
 
-	if config.Server.ID != "" && config.Server.Key != "" {
+	key, err := resolveKey(config.Server.Key, config.Server.KeyFile)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if config.Server.Key != "" && config.Server.KeyFile != "" {
+		problems = append(problems, "Server KEY and KEY_FILE must not both be set")
+	} else if config.Server.ID != "" && key != "" {
 		settings.ID = config.Server.ID
-		settings.Key = config.Server.Key
+		settings.Key = key
+		settings.KeyFile = config.Server.KeyFile
 	} else {
-		log.Error().Msg("Server ID, KEY is empty")
-		valid = false
+		problems = append(problems, "Server ID, KEY is empty")
 	}
 
 	if settings.UseSSL {
@@ -129,13 +347,93 @@ func validateConfig(config Config) (bool, Settings) {
 			settings.SSLOpt["cert_reqs"] = &tls.Config{InsecureSkipVerify: true}
 		} else if caCert != "" {
 			if _, err := os.Stat(caCert); os.IsNotExist(err) {
-				log.Error().Msg("Given path for CA certificate does not exist.")
-				valid = false
+				problems = append(problems, "Given path for CA certificate does not exist")
 			} else {
 				settings.CaCert = caCert
 				settings.SSLOpt["ca_certs"] = caCert
 			}
 		}
+
+		clientCert, clientKey := config.SSL.ClientCert, config.SSL.ClientKey
+		if (clientCert == "") != (clientKey == "") {
+			problems = append(problems, "Client certificate and key must be given together")
+		} else if clientCert != "" {
+			for _, path := range []string{clientCert, clientKey} {
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					problems = append(problems, fmt.Sprintf("Given path for client certificate or key does not exist: %s", path))
+				}
+			}
+			settings.ClientCert = clientCert
+			settings.ClientKey = clientKey
+		}
+
+		pins, err := parsePins(config.SSL.Pins)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("SSL pins are invalid: %s", err))
+		} else if len(pins) == 1 {
+			log.Warn().Msg(
+				"Only one SSL pin is configured. " +
+					"Add a backup pin for the next server key, or rotating the certificate will lock this agent out.",
+			)
+		}
+		settings.Pins = pins
+	}
+
+	if config.Proxy.URL != "" {
+		proxyURL, err := url.Parse(config.Proxy.URL)
+		if err != nil || proxyURL.Host == "" ||
+			(proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") {
+			problems = append(problems, "Proxy url is invalid")
+		} else {
+			settings.ProxyURL = config.Proxy.URL
+			settings.ProxyUsername = config.Proxy.Username
+			settings.ProxyPassword = config.Proxy.Password
+		}
+	}
+	settings.NoProxy = config.Proxy.NoProxy
+
+	tuning := config.Tuning
+	for _, problem := range []string{
+		tune("http_threads", tuning.HTTPThreads, 1, &settings.HTTPThreads),
+		tune("max_queue_size", tuning.MaxQueueSize, 1, &settings.MaxQueueSize),
+		tune("retry_limit", tuning.RetryLimit, 1, &settings.RetryLimit),
+		tune("request_timeout", tuning.RequestTimeout, time.Second, &settings.RequestTimeout),
+		tune("ping_interval", tuning.PingInterval, time.Second, &settings.PingInterval),
+		tune("pong_timeout", tuning.PongTimeout, time.Second, &settings.PongTimeout),
+		tune("min_connect_interval", tuning.MinConnectInterval, time.Second, &settings.MinConnectInterval),
+		tune("max_connect_interval", tuning.MaxConnectInterval, time.Second, &settings.MaxConnectInterval),
+		tune("user_mgmt_timeout", tuning.UserMgmtTimeout, time.Second, &settings.UserMgmtTimeout),
+		tune("ftp_max_list_depth", tuning.FtpMaxListDepth, 1, &settings.FtpMaxListDepth),
+		tune("command_workers", tuning.CommandWorkers, 1, &settings.CommandWorkers),
+		tune("command_backlog", tuning.CommandBacklog, 1, &settings.CommandBacklog),
+		tune("command_output_limit", tuning.CommandOutputLimit, 1, &settings.CommandOutputLimit),
+		tune("command_stream_limit", tuning.CommandStreamLimit, 1, &settings.CommandStreamLimit),
+		tune("gzip_min_size", tuning.GzipMinSize, 1, &settings.GzipMinSize),
+	} {
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if settings.MinConnectInterval > settings.MaxConnectInterval {
+		problems = append(problems, "tuning.min_connect_interval must not exceed tuning.max_connect_interval")
+	}
+	if config.Tuning.Gzip != nil && !*config.Tuning.Gzip {
+		settings.GzipMinSize = 0
+	}
+
+	return settings, problems
+}
+
+// tune overrides a default setting with the value given in [tuning].
+// Zero keeps the default, values below least are rejected with the
+// returned problem.
+func tune[T int | time.Duration](name string, value, least T, setting *T) string {
+	if value == 0 {
+		return ""
+	}
+	if value < least {
+		return fmt.Sprintf("tuning.%s must be at least %v", name, least)
 	}
-	return valid, settings
+	*setting = value
+	return ""
 }
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
+)
+
+func mapConfig(t *testing.T, data string) Config {
+	iniData, err := ini.Load([]byte("[server]\nurl = https://alpacon\nid = id\nkey = key\n" + data))
+	require.NoError(t, err)
+
+	var config Config
+	require.NoError(t, iniData.MapTo(&config))
+	return config
+}
+
+func TestTuning(t *testing.T) {
+	settings, problems := validateConfig(mapConfig(t, ""))
+	assert.Empty(t, problems)
+	assert.Equal(t, defaultHTTPThreads, settings.HTTPThreads)
+	assert.Equal(t, defaultRequestTimeout, settings.RequestTimeout)
+	assert.Equal(t, defaultFtpMaxListDepth, settings.FtpMaxListDepth)
+
+	settings, problems = validateConfig(mapConfig(t, "[tuning]\nhttp_threads = 8\nrequest_timeout = 30s\nmax_connect_interval = 10m\n"))
+	assert.Empty(t, problems)
+	assert.Equal(t, 8, settings.HTTPThreads)
+	assert.Equal(t, 30*time.Second, settings.RequestTimeout)
+	assert.Equal(t, 10*time.Minute, settings.MaxConnectInterval)
+	assert.Equal(t, defaultRetryLimit, settings.RetryLimit)
+
+	_, problems = validateConfig(mapConfig(t, "[tuning]\nretry_limit = -1\n"))
+	assert.NotEmpty(t, problems, "Negative values should be rejected.")
+
+	_, problems = validateConfig(mapConfig(t, "[tuning]\nrequest_timeout = 500ms\n"))
+	assert.NotEmpty(t, problems, "Timeouts below a second should be rejected.")
+
+	_, problems = validateConfig(mapConfig(t, "[tuning]\nmin_connect_interval = 2m\nmax_connect_interval = 1m\n"))
+	assert.NotEmpty(t, problems, "The connect intervals should be ordered.")
+}
+
+func TestChanged(t *testing.T) {
+	old, _ := validateConfig(mapConfig(t, ""))
+	updated, _ := validateConfig(mapConfig(t, "[ssl]\npins = sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=,sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n[logging]\ndebug = true\n"))
+	updated.ServerURL = "https://alpacon.example.com"
+	updated.WSPath = "wss://alpacon.example.com/ws/servers/backhaul/"
+
+	assert.Empty(t, Changed(old, old))
+	assert.ElementsMatch(t, []string{"server.url", "ssl.pins", "logging.debug"}, Changed(old, updated),
+		"Derived settings should not be reported.")
+}
+
+func TestSetEditsTheFileSettingTheKey(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "alpamon.conf")
+	require.NoError(t, os.WriteFile(base, []byte("[server]\nurl = https://alpacon\nid = id\nkey = key\n"), 0640))
+
+	dropInDir = filepath.Join(dir, "conf.d")
+	defer func() { dropInDir = "/etc/alpamon/conf.d" }()
+	require.NoError(t, os.Mkdir(dropInDir, 0700))
+	dropIn := filepath.Join(dropInDir, "tuning.conf")
+	require.NoError(t, os.WriteFile(dropIn, []byte("[tuning]\nhttp_threads = 2\n"), 0600))
+
+	SetCommandLine(base, nil)
+	defer SetCommandLine("", nil)
+
+	path, err := Set("tuning.http_threads", "8")
+	require.NoError(t, err)
+	assert.Equal(t, dropIn, path)
+
+	path, err = Set("logging.debug", "true")
+	require.NoError(t, err)
+	assert.Equal(t, base, path)
+	fileInfo, err := os.Stat(base)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm())
+
+	_, err = Set("tuning.retry_limit", "-1")
+	var invalid *ValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, []string{"tuning.retry_limit must be at least 1"}, invalid.Problems)
+
+	_, err = Set("server.port", "8000")
+	assert.Error(t, err)
+
+	settings, err := ReadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 8, settings.HTTPThreads)
+	assert.True(t, settings.Debug)
+	assert.Equal(t, defaultRetryLimit, settings.RetryLimit)
+
+	dump := Dump(settings)
+	assert.Equal(t, redacted, dump.Section("server").Key("key").Value())
+	assert.Equal(t, "8", dump.Section("tuning").Key("http_threads").Value())
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "alpamon.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("file-key\n"), 0600))
+
+	settings, problems := validateConfig(mapConfig(t, "[server]\nkey = \nkey_file = "+keyFile+"\n"))
+	assert.Empty(t, problems)
+	assert.Equal(t, "file-key", settings.Key)
+	assert.Equal(t, keyFile, settings.KeyFile)
+
+	_, problems = validateConfig(mapConfig(t, "[server]\nkey_file = "+keyFile+"\n"))
+	assert.Contains(t, problems, "Server KEY and KEY_FILE must not both be set")
+
+	require.NoError(t, os.Chmod(keyFile, 0644))
+	_, problems = validateConfig(mapConfig(t, "[server]\nkey = \nkey_file = "+keyFile+"\n"))
+	assert.NotEmpty(t, problems, "World-readable key files should be refused.")
+
+	credentials := filepath.Join(dir, "credentials")
+	require.NoError(t, os.Mkdir(credentials, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, keyCredential), []byte("credential-key"), 0400))
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+
+	settings, problems = validateConfig(mapConfig(t, "[server]\nkey = \nkey_file = "+filepath.Join(dir, "missing.key")+"\n"))
+	assert.Empty(t, problems)
+	assert.Equal(t, "credential-key", settings.Key, "The credential should stand in for a missing key file.")
+
+	settings, problems = validateConfig(mapConfig(t, "[server]\nkey = \n"))
+	assert.Empty(t, problems)
+	assert.Equal(t, "credential-key", settings.Key)
+}
+
+func TestUpdateKeyWritesToTheAppliedConfig(t *testing.T) {
+	dir := t.TempDir()
+	dropInDir = filepath.Join(dir, "conf.d")
+	defer func() { dropInDir = "/etc/alpamon/conf.d" }()
+
+	applied := filepath.Join(dir, "alpamon.conf")
+	require.NoError(t, os.WriteFile(applied, []byte("[server]\nurl = https://alpacon\nid = id\nkey = key\n"), 0600))
+	SetCommandLine(applied, nil)
+	defer SetCommandLine("", nil)
+
+	settings, err := ReadConfig()
+	require.NoError(t, err)
+	previous := *GlobalSettings()
+	InitSettings(settings)
+	t.Cleanup(func() { InitSettings(previous) })
+
+	invalid := filepath.Join(dir, "invalid.conf")
+	require.NoError(t, os.WriteFile(invalid, []byte("[server]\nurl = https://alpacon\nid = id\nkey = key\n[tuning]\nretry_limit = -1\n"), 0600))
+	SetCommandLine(invalid, nil)
+	_, err = ReadConfig()
+	require.Error(t, err)
+
+	require.NoError(t, UpdateKey("rotated"))
+	data, err := os.ReadFile(applied)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "rotated", "The key should go to the config in effect.")
+	data, err = os.ReadFile(invalid)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "rotated", "A rejected reload should not redirect the key.")
+}
+
+func TestValidateFileLeavesOutOtherLayers(t *testing.T) {
+	dir := t.TempDir()
+	dropInDir = filepath.Join(dir, "conf.d")
+	defer func() { dropInDir = "/etc/alpamon/conf.d" }()
+	require.NoError(t, os.Mkdir(dropInDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "tuning.conf"), []byte("[tuning]\nretry_limit = -1\n"), 0600))
+
+	base := filepath.Join(dir, "alpamon.conf")
+	require.NoError(t, os.WriteFile(base, []byte("[server]\nurl = https://alpacon\nid = id\nkey = key\n"), 0600))
+	SetCommandLine(base, nil)
+	defer SetCommandLine("", nil)
+
+	_, err := ReadConfig()
+	assert.Error(t, err, "The merged configuration holds the invalid drop-in.")
+	assert.NoError(t, ValidateFile(base), "The file should be checked on its own.")
+
+	require.NoError(t, os.WriteFile(base, []byte("[server]\nurl = https://alpacon\nid = id\n"), 0600))
+	var invalid *ValidationError
+	assert.ErrorAs(t, ValidateFile(base), &invalid)
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keyCredential is the name of the systemd credential holding the server
+// key, see LoadCredential= in alpamon.service.
+const keyCredential = "alpamon-key"
+
+// credentialKeyFile returns the path of the server key passed by systemd,
+// or an empty string if there is none.
+func credentialKeyFile() string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+
+	path := filepath.Join(dir, keyCredential)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// resolveKey returns the server key from the key file, or else from the
+// key itself. The systemd credential stands in for a key file that alpamon
+// cannot read, or for both when neither is given. Rotated keys are written
+// to the key file, so it is preferred over the credential, which is a copy
+// taken when the service started.
+func resolveKey(key, keyFile string) (string, error) {
+	credential := credentialKeyFile()
+	if keyFile != "" {
+		fileKey, err := readKeyFile(keyFile)
+		if credential != "" && (errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)) {
+			return readKeyFile(credential)
+		}
+		return fileKey, err
+	}
+	if credential != "" && key == "" {
+		return readKeyFile(credential)
+	}
+	return key, nil
+}
+
+// readKeyFile reads the server key from path. Files readable by other
+// users are refused, as anyone holding the key can impersonate the server.
+func readKeyFile(path string) (string, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %w", err)
+	}
+	if fileInfo.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("key file %s must not be readable by other users (mode %04o)", path, fileInfo.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	envPrefix = "ALPAMON_"
+
+	envSourcePrefix  = "env "
+	flagSourcePrefix = "flag --set "
+)
+
+var errNoConfig = errors.New("no valid config file found")
+
+var (
+	dropInDir = "/etc/alpamon/conf.d"
+
+	// baseConfigFile, if set with --config, replaces the search in configFiles.
+	baseConfigFile string
+	// flagOverrides are the section.key=value pairs given with --set.
+	flagOverrides []string
+)
+
+// SetCommandLine records the config file and overrides given on the command
+// line. It must be called before LoadConfig.
+func SetCommandLine(configFile string, overrides []string) {
+	baseConfigFile = configFile
+	flagOverrides = overrides
+}
+
+// Sources returns where the effective value of each key set in the applied
+// configuration came from: a file path, an environment variable or a flag.
+// Keys left to their defaults are not listed.
+func Sources() map[string]string {
+	settings := GlobalSettings()
+	sources := make(map[string]string, len(settings.sources))
+	for key, source := range settings.sources {
+		sources[key] = source
+	}
+	return sources
+}
+
+// findBaseConfigFile returns the config file given with --config, or else
+// the first non-empty file among configFiles, or an empty string if none exists.
+func findBaseConfigFile() string {
+	if baseConfigFile != "" {
+		return baseConfigFile
+	}
+
+	for _, configFile := range configFiles {
+		fileInfo, statErr := os.Stat(configFile)
+		if statErr != nil {
+			if !os.IsNotExist(statErr) {
+				log.Error().Err(statErr).Msgf("Error accessing config file %s", configFile)
+			}
+			continue
+		}
+
+		if fileInfo.Size() == 0 {
+			log.Debug().Msgf("Config file %s is empty, skipping...", configFile)
+			continue
+		}
+
+		return configFile
+	}
+
+	return ""
+}
+
+// loadLayers merges the configuration from, in increasing precedence: the
+// base file, the drop-ins in dropInDir in lexical order, ALPAMON_SECTION_KEY
+// environment variables and --set flags. It returns the merged file and
+// the source of each key.
+func loadLayers(baseFile string) (*ini.File, map[string]string, error) {
+	merged := ini.Empty()
+	sources := make(map[string]string)
+	set := func(source, section, key, value string) {
+		merged.Section(section).Key(key).SetValue(value)
+		sources[section+"."+key] = source
+	}
+
+	var files []string
+	if baseFile != "" {
+		files = append(files, baseFile)
+	}
+	dropIns, err := filepath.Glob(filepath.Join(dropInDir, "*.conf"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(dropIns)
+	files = append(files, dropIns...)
+
+	for _, file := range files {
+		iniData, err := ini.Load(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load config file %s: %w", file, err)
+		}
+		log.Debug().Msgf("Using config file %s", file)
+
+		for _, section := range iniData.Sections() {
+			if section.Name() == ini.DefaultSection {
+				continue
+			}
+			for _, key := range section.Keys() {
+				set(file, section.Name(), key.Name(), key.Value())
+			}
+		}
+	}
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		// Section names have no underscores, keys may have some.
+		section, key, ok := strings.Cut(strings.ToLower(strings.TrimPrefix(name, envPrefix)), "_")
+		if !ok || section == "" || key == "" {
+			continue
+		}
+		set(envSourcePrefix+name, section, key, value)
+	}
+
+	for _, override := range flagOverrides {
+		name, value, ok := strings.Cut(override, "=")
+		section, key, dotted := strings.Cut(strings.TrimSpace(name), ".")
+		if !ok || !dotted || section == "" || key == "" {
+			return nil, nil, fmt.Errorf("invalid override %q, expected section.key=value", override)
+		}
+		set(flagSourcePrefix+name, section, key, value)
+	}
+
+	if len(sources) == 0 {
+		return nil, nil, errNoConfig
+	}
+
+	return merged, sources, nil
+}
+
+// isFileSource reports whether a source recorded by loadLayers is a file.
+func isFileSource(source string) bool {
+	return !strings.HasPrefix(source, envSourcePrefix) && !strings.HasPrefix(source, flagSourcePrefix)
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadLayersPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "alpamon.conf")
+	require.NoError(t, os.WriteFile(base, []byte("[server]\nurl = https://base\nid = base-id\nkey = base-key\n[logging]\ndebug = false\n"), 0600))
+
+	dropInDir = filepath.Join(dir, "conf.d")
+	defer func() { dropInDir = "/etc/alpamon/conf.d" }()
+	require.NoError(t, os.Mkdir(dropInDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "20-debug.conf"), []byte("[logging]\ndebug = true\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "10-server.conf"), []byte("[server]\nid = drop-in-id\nurl = https://drop-in\n"), 0600))
+
+	t.Setenv("ALPAMON_SERVER_URL", "https://env")
+	t.Setenv("ALPAMON_TUNING_MAX_QUEUE_SIZE", "10")
+	SetCommandLine("", []string{"server.url=https://flag"})
+	defer SetCommandLine("", nil)
+
+	iniData, sources, err := loadLayers(base)
+	require.NoError(t, err)
+
+	var config Config
+	require.NoError(t, iniData.MapTo(&config))
+	assert.Equal(t, "https://flag", config.Server.URL)
+	assert.Equal(t, "drop-in-id", config.Server.ID)
+	assert.Equal(t, "base-key", config.Server.Key)
+	assert.True(t, config.Logging.Debug)
+	assert.Equal(t, 10, config.Tuning.MaxQueueSize)
+
+	assert.Equal(t, "flag --set server.url", sources["server.url"])
+	assert.Equal(t, filepath.Join(dropInDir, "10-server.conf"), sources["server.id"])
+	assert.Equal(t, base, sources["server.key"])
+	assert.Equal(t, "env ALPAMON_TUNING_MAX_QUEUE_SIZE", sources["tuning.max_queue_size"])
+}
+
+func TestInvalidOverrideIsRejected(t *testing.T) {
+	SetCommandLine("", []string{"debug=true"})
+	defer SetCommandLine("", nil)
+
+	_, _, err := loadLayers("")
+	assert.Error(t, err)
+}
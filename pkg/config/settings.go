@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+const redacted = "<redacted>"
+
+// secretKeys hold credentials, which Dump never prints.
+var secretKeys = map[string]bool{
+	"server.key":     true,
+	"proxy.password": true,
+}
+
+// Changed returns the keys, e.g. "server.url", whose settings differ
+// between old and updated.
+func Changed(old, updated Settings) []string {
+	var keys []string
+
+	oldValue, updatedValue := reflect.ValueOf(old), reflect.ValueOf(updated)
+	for i := 0; i < oldValue.NumField(); i++ {
+		key := oldValue.Type().Field(i).Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), updatedValue.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Dump renders the settings in INI format with secrets redacted. Keys set
+// by the loaded configuration are commented with their source, the others
+// with their default.
+func Dump(settings Settings) *ini.File {
+	dump := ini.Empty()
+
+	value := reflect.ValueOf(settings)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("config")
+		if name == "" {
+			continue
+		}
+
+		section, key, _ := strings.Cut(name, ".")
+		entry := dump.Section(section).Key(key)
+		entry.SetValue(formatSetting(name, value.Field(i).Interface()))
+		if source, ok := settings.sources[name]; ok {
+			entry.Comment = "from " + source
+		} else {
+			entry.Comment = "default"
+		}
+	}
+
+	return dump
+}
+
+func formatSetting(name string, value interface{}) string {
+	switch value := value.(type) {
+	case []string:
+		return strings.Join(value, ",")
+	case string:
+		if value == "" {
+			return ""
+		}
+		if secretKeys[name] {
+			return redacted
+		}
+		// Proxy credentials may be given in the URL too.
+		if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+			return parsed.Redacted()
+		}
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Set writes a section.key value to the config file that currently sets
+// the key, or else to the base config file, creating it if there is none.
+// It returns the path written to. A value that would add problems to the
+// configuration is refused with a *ValidationError, but problems that are
+// already there do not prevent fixing them one key at a time.
+func Set(name, value string) (string, error) {
+	section, key, _ := strings.Cut(name, ".")
+	if !isKnownKey(name) {
+		return "", fmt.Errorf("unknown config key %q", name)
+	}
+
+	baseFile := findBaseConfigFile()
+	iniData, sources, err := loadLayers(baseFile)
+	if errors.Is(err, errNoConfig) {
+		iniData, sources = ini.Empty(), map[string]string{}
+	} else if err != nil {
+		return "", err
+	}
+
+	path := baseFile
+	if source, ok := sources[name]; ok {
+		if !isFileSource(source) {
+			return "", fmt.Errorf("%s is set by %s, which takes precedence over config files", name, source)
+		}
+		path = source
+	}
+	if path == "" {
+		path = configFiles[0]
+	}
+
+	target := iniData.Section(section)
+	existed := target.HasKey(key)
+	previous := target.Key(key).Value()
+	target.Key(key).SetValue(value)
+	if problems := problemsOf(iniData); len(problems) > 0 {
+		if existed {
+			target.Key(key).SetValue(previous)
+		} else {
+			target.DeleteKey(key)
+		}
+		existing := problemsOf(iniData)
+
+		var added []string
+		for _, problem := range problems {
+			if !slices.Contains(existing, problem) {
+				added = append(added, problem)
+			}
+		}
+		if len(added) > 0 {
+			return "", &ValidationError{Problems: added}
+		}
+	}
+
+	err = updateConfigFile(path, func(iniData *ini.File) {
+		iniData.Section(section).Key(key).SetValue(value)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// problemsOf validates merged configuration data.
+func problemsOf(iniData *ini.File) []string {
+	var config Config
+	if err := iniData.StrictMapTo(&config); err != nil {
+		return []string{err.Error()}
+	}
+
+	_, problems := validateConfig(config)
+	return problems
+}
+
+// isKnownKey reports whether section.key is read into Config.
+func isKnownKey(name string) bool {
+	sections := reflect.TypeOf(Config{})
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			if section.Tag.Get("ini")+"."+section.Type.Field(j).Tag.Get("ini") == name {
+				return true
+			}
+		}
+	}
+	return false
+}
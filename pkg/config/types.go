@@ -1,28 +1,89 @@
 package config
 
+import "time"
+
+// Settings are the validated configuration. The config tag names the key
+// each field is read from, fields without one are derived from others.
 type Settings struct {
-	ServerURL   string
-	WSPath      string
-	UseSSL      bool
-	CaCert      string // CA certificate file path
-	SSLVerify   bool
-	SSLOpt      map[string]interface{}
-	HTTPThreads int
-	ID          string
-	Key         string
+	ServerURL     string `config:"server.url"`
+	WSPath        string
+	UseSSL        bool
+	CaCert        string   `config:"ssl.ca_cert"` // CA certificate file path
+	SSLVerify     bool     `config:"ssl.verify"`
+	ClientCert    string   `config:"ssl.client_cert"` // client certificate file path for mutual TLS
+	ClientKey     string   `config:"ssl.client_key"`  // client key file path for mutual TLS
+	Pins          []string `config:"ssl.pins"`        // base64-encoded SHA-256 digests of pinned public keys
+	ProxyURL      string   `config:"proxy.url"`
+	ProxyUsername string   `config:"proxy.username"`
+	ProxyPassword string   `config:"proxy.password"`
+	NoProxy       string   `config:"proxy.no_proxy"` // comma-separated hosts reached without the proxy
+	SSLOpt        map[string]interface{}
+	HTTPThreads   int    `config:"tuning.http_threads"`
+	MaxQueueSize  int    `config:"tuning.max_queue_size"`
+	RetryLimit    int    `config:"tuning.retry_limit"`
+	GzipMinSize   int    `config:"tuning.gzip_min_size"` // smallest request body sent gzipped, 0 disables compression
+	ID            string `config:"server.id"`
+	Key           string `config:"server.key"`
+	KeyFile       string `config:"server.key_file"` // where rotated keys are written, if the key is kept apart
+	Debug         bool   `config:"logging.debug"`
+
+	RequestTimeout     time.Duration `config:"tuning.request_timeout"`
+	PingInterval       time.Duration `config:"tuning.ping_interval"` // between websocket pings
+	PongTimeout        time.Duration `config:"tuning.pong_timeout"`  // until a websocket without pong is dropped
+	MinConnectInterval time.Duration `config:"tuning.min_connect_interval"`
+	MaxConnectInterval time.Duration `config:"tuning.max_connect_interval"`
+	UserMgmtTimeout    time.Duration `config:"tuning.user_mgmt_timeout"`
+	FtpMaxListDepth    int           `config:"tuning.ftp_max_list_depth"`
+	CommandWorkers     int           `config:"tuning.command_workers"`      // commands run at once
+	CommandBacklog     int           `config:"tuning.command_backlog"`      // commands waiting for a worker
+	CommandOutputLimit int           `config:"tuning.command_output_limit"` // bytes of output kept for the result
+	CommandStreamLimit int           `config:"tuning.command_stream_limit"` // bytes of output streamed per command
+
+	// Where the settings were loaded from, so that a rotated key can be
+	// written back. They are replaced along with the settings on reload.
+	configFile string            // the base config file
+	sources    map[string]string // where each section.key set came from
 }
 
 type Config struct {
 	Server struct {
-		URL string `ini:"url"`
-		ID  string `ini:"id"`
-		Key string `ini:"key"`
+		URL     string `ini:"url"`
+		ID      string `ini:"id"`
+		Key     string `ini:"key"`
+		KeyFile string `ini:"key_file"`
 	} `ini:"server"`
 	SSL struct {
-		Verify bool   `ini:"verify"`
-		CaCert string `ini:"ca_cert"`
+		Verify     bool   `ini:"verify"`
+		CaCert     string `ini:"ca_cert"`
+		ClientCert string `ini:"client_cert"`
+		ClientKey  string `ini:"client_key"`
+		Pins       string `ini:"pins"`
 	} `ini:"ssl"`
+	Proxy struct {
+		URL      string `ini:"url"`
+		Username string `ini:"username"`
+		Password string `ini:"password"`
+		NoProxy  string `ini:"no_proxy"`
+	} `ini:"proxy"`
 	Logging struct {
 		Debug bool `ini:"debug"`
 	} `ini:"logging"`
+	Tuning struct {
+		HTTPThreads        int           `ini:"http_threads"`
+		MaxQueueSize       int           `ini:"max_queue_size"`
+		RetryLimit         int           `ini:"retry_limit"`
+		RequestTimeout     time.Duration `ini:"request_timeout"`
+		PingInterval       time.Duration `ini:"ping_interval"`
+		PongTimeout        time.Duration `ini:"pong_timeout"`
+		MinConnectInterval time.Duration `ini:"min_connect_interval"`
+		MaxConnectInterval time.Duration `ini:"max_connect_interval"`
+		UserMgmtTimeout    time.Duration `ini:"user_mgmt_timeout"`
+		FtpMaxListDepth    int           `ini:"ftp_max_list_depth"`
+		CommandWorkers     int           `ini:"command_workers"`
+		CommandBacklog     int           `ini:"command_backlog"`
+		CommandOutputLimit int           `ini:"command_output_limit"`
+		CommandStreamLimit int           `ini:"command_stream_limit"`
+		Gzip               *bool         `ini:"gzip"`
+		GzipMinSize        int           `ini:"gzip_min_size"`
+	} `ini:"tuning"`
 }
@@ -1,45 +1,54 @@
 package runner
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alpacanetworks/alpamon-go/pkg/config"
 	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
+	"github.com/alpacanetworks/alpamon-go/pkg/utils"
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const (
-	minConnectInterval    = 5 * time.Second
-	maxConnectInterval    = 60 * time.Second
-	connectionReadTimeout = 35 * time.Minute
-
 	eventCommandAckURL = "/api/events/commands/%s/ack/"
 	eventCommandFinURL = "/api/events/commands/%s/fin/"
 )
 
+// WebsocketClient keeps the backhaul connection. conn is only used by the
+// goroutine running RunForever; other goroutines end the connection through
+// disconnect, which makes its pending read fail.
 type WebsocketClient struct {
 	conn             *websocket.Conn
+	connCtx          context.Context // done once the connection should end
+	mu               sync.Mutex      // guards disconnect
+	disconnect       context.CancelFunc
 	requestHeader    http.Header
 	apiSession       *scheduler.Session
 	RestartRequested bool
-	quitChan         chan struct{}
+	ctx              context.Context
+	cancel           context.CancelFunc
+	commands         *commandExecutor
 }
 
-func NewWebsocketClient(session *scheduler.Session) *WebsocketClient {
-	headers := http.Header{
-		"Authorization": {fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)},
-		"Origin":        {config.GlobalSettings.ServerURL},
-	}
+// NewWebsocketClient creates the backhaul client. It stops accepting
+// commands once ctx is done or a quit is requested.
+func NewWebsocketClient(ctx context.Context, session *scheduler.Session) *WebsocketClient {
+	ctx, cancel := context.WithCancel(ctx)
 
 	return &WebsocketClient{
-		requestHeader:    headers,
+		requestHeader:    http.Header{},
 		apiSession:       session,
 		RestartRequested: false,
-		quitChan:         make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
+		commands:         newCommandExecutor(),
 	}
 }
 
@@ -47,24 +56,33 @@ func (wc *WebsocketClient) RunForever() {
 	wc.connect()
 	defer wc.close()
 
-	for {
-		select {
-		case <-wc.quitChan:
-			return
-		default:
-			err := wc.conn.SetReadDeadline(time.Now().Add(connectionReadTimeout))
-			if err != nil {
-				wc.closeAndReconnect()
+	for wc.ctx.Err() == nil {
+		_, message, err := wc.readMessage()
+		if err != nil {
+			if wc.ctx.Err() != nil {
+				return
 			}
-			_, message, err := wc.readMessage()
-			if err != nil {
-				wc.closeAndReconnect()
+			// A requested reconnect fails the read with a timeout as well.
+			if wc.connCtx.Err() == nil && isPongTimeout(err) {
+				settings := config.GlobalSettings()
+				log.Warn().Msgf("No pong from %s within %s, reconnecting.", settings.WSPath, settings.PongTimeout)
 			}
-			// Sends "ping" query for Alpacon to verify WebSocket session status without error handling.
-			_ = wc.sendPingQuery()
-			wc.commandRequestHandler(message)
+			wc.closeAndReconnect()
 		}
+		// Sends "ping" query for Alpacon to verify WebSocket session status without error handling.
+		_ = wc.sendPingQuery()
+		wc.commandRequestHandler(message)
+	}
+}
+
+// WaitForCommands fails the commands still waiting for a worker, then waits
+// for the running ones to finish and queue their results, giving up after
+// timeout. It reports whether all of them finished.
+func (wc *WebsocketClient) WaitForCommands(timeout time.Duration) bool {
+	for _, runner := range wc.commands.close() {
+		runner.reject(errExecutorClosed.Error())
 	}
+	return utils.WaitTimeout(&wc.commands.wg, timeout)
 }
 
 func (wc *WebsocketClient) sendPingQuery() error {
@@ -87,29 +105,42 @@ func (wc *WebsocketClient) readMessage() (messageType int, message []byte, err e
 }
 
 func (wc *WebsocketClient) connect() {
-	log.Info().Msgf("Connecting to websocket at %s...", config.GlobalSettings.WSPath)
+	settings := config.GlobalSettings()
+	log.Info().Msgf("Connecting to websocket at %s...", settings.WSPath)
 
 	wsBackoff := backoff.NewExponentialBackOff()
-	wsBackoff.InitialInterval = minConnectInterval
-	wsBackoff.MaxInterval = maxConnectInterval
+	wsBackoff.InitialInterval = settings.MinConnectInterval
+	wsBackoff.MaxInterval = settings.MaxConnectInterval
 	wsBackoff.MaxElapsedTime = 0      // No time limit for retries (infinite retry)
 	wsBackoff.RandomizationFactor = 0 // Retry forever
 
+	// The URL or the key may have changed since the last connection.
+	wc.requestHeader.Set("Origin", settings.ServerURL)
+	wc.requestHeader.Set("Authorization", fmt.Sprintf(`id="%s", key="%s"`, settings.ID, settings.Key))
+
 	operation := func() error {
-		conn, _, err := websocket.DefaultDialer.Dial(config.GlobalSettings.WSPath, wc.requestHeader)
+		conn, _, err := scheduler.NewDialer().Dial(settings.WSPath, wc.requestHeader)
 		if err != nil {
 			nextInterval := wsBackoff.NextBackOff()
-			log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", config.GlobalSettings.WSPath, int(nextInterval.Seconds()))
+			log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", settings.WSPath, int(nextInterval.Seconds()))
 			return err
 		}
 
-		wc.conn = conn
+		ctx, cancel := context.WithCancel(wc.ctx)
+		keepAlive(ctx, conn, settings.PingInterval, settings.PongTimeout)
+		wc.conn, wc.connCtx = conn, ctx
+		wc.mu.Lock()
+		wc.disconnect = cancel
+		wc.mu.Unlock()
 		log.Debug().Msg("Backhaul connection established.")
 		return nil
 	}
 
-	err := backoff.Retry(operation, wsBackoff)
+	err := backoff.Retry(operation, backoff.WithContext(wsBackoff, wc.ctx))
 	if err != nil {
+		if wc.ctx.Err() != nil {
+			return
+		}
 		log.Error().Err(err).Msg("Unexpected error occurred during backoff.")
 		return
 	}
@@ -121,9 +152,11 @@ func (wc *WebsocketClient) closeAndReconnect() {
 }
 
 // Cleanly close the websocket connection by sending a close message
-// Do not close quitChan, as the purpose here is to disconnect the WebSocket,
-// not to terminate RunForever.
+// Do not cancel the context, as the purpose here is to disconnect the WebSocket,
+// not to terminate RunForever. It must only be called by the goroutine
+// running RunForever.
 func (wc *WebsocketClient) close() {
+	wc.endConnection()
 	if wc.conn != nil {
 		err := wc.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		if err != nil {
@@ -133,9 +166,24 @@ func (wc *WebsocketClient) close() {
 	}
 }
 
+// Reconnect makes RunForever close the backhaul connection and open it
+// again with the current settings. It may be called from any goroutine.
+func (wc *WebsocketClient) Reconnect() {
+	wc.endConnection()
+}
+
+// endConnection fails the pending read on the current connection, if any.
+func (wc *WebsocketClient) endConnection() {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if wc.disconnect != nil {
+		wc.disconnect()
+	}
+}
+
 func (wc *WebsocketClient) quit() {
-	wc.close()
-	close(wc.quitChan)
+	wc.cancel()
 }
 
 func (wc *WebsocketClient) restart() {
@@ -167,24 +215,77 @@ func (wc *WebsocketClient) commandRequestHandler(message []byte) {
 
 	switch content.Query {
 	case "command":
-		scheduler.Rqueue.Post(fmt.Sprintf(eventCommandAckURL, content.Command.ID),
-			nil,
-			10,
-			time.Time{},
-		)
+		ackURL := fmt.Sprintf(eventCommandAckURL, content.Command.ID)
 		runner := NewCommandRunner(wc, content.Command, data)
-		go runner.Run()
+		err = wc.commands.submit(runner, func(position int) {
+			scheduler.Rqueue.Post(ackURL, &commandAck{QueuePosition: position}, 10, time.Time{})
+		})
+		if err != nil {
+			scheduler.Rqueue.Post(ackURL, nil, 10, time.Time{})
+			runner.reject(err.Error())
+		}
+	case "cancel":
+		wc.cancelCommand(content.Command.ID)
 	case "quit":
 		log.Debug().Msgf("Quit requested for reason: %s", content.Reason)
 		wc.quit()
 	case "reconnect":
 		log.Debug().Msgf("Reconnect requested for reason: %s", content.Reason)
-		wc.close()
+		wc.Reconnect()
+	case "rotatekey":
+		log.Info().Msg("Server key rotation requested.")
+		err = wc.rotateKey(content.Key)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to rotate the server key.")
+		}
 	default:
 		log.Warn().Msgf("Not implemented query: %s", content.Query)
 	}
 }
 
+// cancelCommand stops the command with the given ID. A running command is
+// terminated and reports its output so far, a waiting one is dropped.
+func (wc *WebsocketClient) cancelCommand(id string) {
+	dropped, found := wc.commands.cancel(id)
+	if !found {
+		log.Warn().Msgf("Cancel requested for command %s, which is not running.", id)
+		return
+	}
+
+	log.Info().Msgf("Cancelling command %s.", id)
+	if dropped != nil {
+		dropped.postFin(commandCancelled, -1, "", 0)
+	}
+}
+
+// rotateKey replaces the server key. The new key is checked against Alpacon
+// first, so a rejected key leaves the config file and the live credentials
+// untouched. Once accepted, it is written to the config file, swapped into
+// the session and the backhaul reconnects with it.
+func (wc *WebsocketClient) rotateKey(key string) error {
+	if key == "" {
+		return errors.New("no key provided")
+	}
+
+	id := config.GlobalSettings().ID
+	err := wc.apiSession.CheckCredentials(id, key)
+	if err != nil {
+		return fmt.Errorf("new key was rejected, keeping the current one: %w", err)
+	}
+
+	err = config.UpdateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to save the new key, keeping the current one: %w", err)
+	}
+
+	config.UpdateSettings(func(settings *config.Settings) { settings.Key = key })
+	wc.apiSession.SetCredentials(id, key)
+	log.Info().Msg("Server key rotated, reconnecting backhaul.")
+	wc.Reconnect()
+
+	return nil
+}
+
 func (wc *WebsocketClient) writeJSON(data interface{}) error {
 	err := wc.conn.WriteJSON(data)
 	if err != nil {
@@ -3,7 +3,9 @@ package runner
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -33,8 +36,18 @@ func NewCommandRunner(wsClient *WebsocketClient, command Command, data CommandDa
 		name = fmt.Sprintf("CommandRunner-%s", strings.Split(command.ID, "-")[0])
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var output *outputStream
+	if command.ID != "" {
+		output = newOutputStream(command.ID)
+	}
+
 	return &CommandRunner{
 		name:      name,
+		ctx:       ctx,
+		cancel:    cancel,
+		output:    output,
 		command:   command,
 		data:      data,
 		wsClient:  wsClient,
@@ -46,6 +59,8 @@ func (cr *CommandRunner) Run() {
 	var exitCode int
 	var result string
 
+	defer cr.cancel()
+
 	log.Debug().Msgf("Received command: %s> %s", cr.command.Shell, cr.command.Line)
 
 	start := time.Now()
@@ -63,16 +78,48 @@ func (cr *CommandRunner) Run() {
 		result = "Invalid command shell argument."
 	}
 
-	if result != "" && cr.command.ID != "" {
-		url := fmt.Sprintf(eventCommandFinURL, cr.command.ID)
+	// A cancelled command reports whatever output it produced until then.
+	status := commandSucceeded
+	if cr.ctx.Err() != nil {
+		log.Info().Msgf("Command %s> %s was cancelled.", cr.command.Shell, cr.command.Line)
+		status = commandCancelled
+	} else if exitCode != 0 {
+		status = commandFailed
+	}
 
-		payload := &commandFin{
-			Success:     exitCode == 0,
-			Result:      result,
-			ElapsedTime: time.Since(start).Seconds(),
-		}
-		scheduler.Rqueue.Post(url, payload, 10, time.Time{})
+	cr.postFin(status, exitCode, result, time.Since(start))
+}
+
+// reject reports a command that was never run as failed.
+func (cr *CommandRunner) reject(reason string) {
+	log.Warn().Msgf("Rejected command %s> %s: %s", cr.command.Shell, cr.command.Line, reason)
+	cr.postFin(commandFailed, -1, reason, 0)
+}
+
+func (cr *CommandRunner) postFin(status string, exitCode int, result string, elapsed time.Duration) {
+	if cr.command.ID == "" {
+		return
+	}
+
+	url := fmt.Sprintf(eventCommandFinURL, cr.command.ID)
+	payload := &commandFin{
+		Success:     status == commandSucceeded,
+		Status:      status,
+		Result:      result,
+		ElapsedTime: elapsed.Seconds(),
+		ExitCode:    exitCode,
+	}
+	cr.output.finish(payload)
+
+	// A fin goes ahead of most requests, but not of the output it refers
+	// to, which is queued at a lower priority. Only a chunk that is being
+	// retried can still arrive after it, which Alpacon tells from
+	// OutputChunks.
+	priority := 10
+	if payload.OutputChunks > 0 {
+		priority = outputPriority
 	}
+	scheduler.Rqueue.Post(url, payload, priority, time.Time{})
 }
 
 func (cr *CommandRunner) handleInternalCmd() (int, string) {
@@ -117,8 +164,18 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 		return cr.delGroup()
 	case "ping":
 		return 0, time.Now().Format(time.RFC3339)
-	//case "debug":
-	//	TODO : getReporterStats()
+	case "rotatekey":
+		err := cr.wsClient.rotateKey(cr.data.Key)
+		if err != nil {
+			return 1, fmt.Sprintf("rotatekey: %s", err.Error())
+		}
+		return 0, "Rotated the server key."
+	case "debug":
+		stats, err := json.Marshal(scheduler.GetReporterStats())
+		if err != nil {
+			return 1, err.Error()
+		}
+		return 0, string(stats)
 	case "download":
 		return cr.runFileDownload(args[1])
 	case "upload":
@@ -162,8 +219,8 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 
 		return 0, "Spawned a ftp terminal."
 	case "resizepty":
-		if terminals[cr.data.SessionID] != nil {
-			err := terminals[cr.data.SessionID].resize(cr.data.Rows, cr.data.Cols)
+		if terminal := getTerminal(cr.data.SessionID); terminal != nil {
+			err := terminal.resize(cr.data.Rows, cr.data.Cols)
 			if err != nil {
 				return 1, err.Error()
 			}
@@ -211,6 +268,8 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 		update: update system
 		reboot: reboot system
 		shutdown: shutdown system
+		debug: show request scheduler statistics
+		rotatekey: replace the server key with the one given in data
 		`
 		return 0, helpMessage
 	default:
@@ -230,7 +289,7 @@ func (cr *CommandRunner) handleShellCmd(command, user, group string, env map[str
 	for _, arg := range spl {
 		switch arg {
 		case "&&":
-			exitCode, result = runCmd(args, user, group, env, 0)
+			exitCode, result = runCmd(cr.ctx, cr.output, args, user, group, env, 0)
 			results += result
 			// stop executing if command fails
 			if exitCode != 0 {
@@ -238,7 +297,7 @@ func (cr *CommandRunner) handleShellCmd(command, user, group string, env map[str
 			}
 			args = []string{}
 		case "||":
-			exitCode, result = runCmd(args, user, group, env, 0)
+			exitCode, result = runCmd(cr.ctx, cr.output, args, user, group, env, 0)
 			results += result
 			// execute next only if command fails
 			if exitCode == 0 {
@@ -246,13 +305,13 @@ func (cr *CommandRunner) handleShellCmd(command, user, group string, env map[str
 			}
 			args = []string{}
 		case ";":
-			exitCode, result = runCmd(args, user, group, env, 0)
+			exitCode, result = runCmd(cr.ctx, cr.output, args, user, group, env, 0)
 			results += result
 			args = []string{}
 		default:
 			if strings.HasSuffix(arg, ";") {
 				args = append(args, strings.TrimSuffix(arg, ";"))
-				exitCode, result = runCmd(args, user, group, env, 0)
+				exitCode, result = runCmd(cr.ctx, cr.output, args, user, group, env, 0)
 				results += result
 				args = []string{}
 			} else {
@@ -263,7 +322,7 @@ func (cr *CommandRunner) handleShellCmd(command, user, group string, env map[str
 
 	if len(args) > 0 {
 		log.Debug().Msgf("Running '%s'", strings.Join(args, " "))
-		exitCode, result = runCmd(args, user, group, env, 0)
+		exitCode, result = runCmd(cr.ctx, cr.output, args, user, group, env, 0)
 		results += result
 	}
 
@@ -296,6 +355,8 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/adduser",
 				"--home", data.HomeDirectory,
@@ -306,7 +367,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 				"--disabled-password",
 				data.Username,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
@@ -324,12 +385,14 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 
 			// invoke adduser
 			exitCode, result = runCmd(
+				cr.ctx,
+				cr.output,
 				[]string{
 					"/usr/sbin/adduser",
 					data.Username,
 					group.Name,
 				},
-				"root", "", nil, 60,
+				"root", "", nil, userMgmtTimeout(),
 			)
 			if exitCode != 0 {
 				return exitCode, result
@@ -337,6 +400,8 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/useradd",
 				"--home-dir", data.HomeDirectory,
@@ -347,7 +412,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 				"--comment", data.Comment,
 				data.Username,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
@@ -373,24 +438,28 @@ func (cr *CommandRunner) addGroup() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/addgroup",
 				"--gid", strconv.FormatUint(data.GID, 10),
 				data.Groupname,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/groupadd",
 				"--gid", strconv.FormatUint(data.GID, 10),
 				data.Groupname,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
@@ -415,22 +484,26 @@ func (cr *CommandRunner) delUser() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/deluser",
 				data.Username,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/userdel",
 				data.Username,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
@@ -455,22 +528,26 @@ func (cr *CommandRunner) delGroup() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/delgroup",
 				data.Groupname,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmd(
+			cr.ctx,
+			cr.output,
 			[]string{
 				"/usr/sbin/groupdel",
 				data.Groupname,
 			},
-			"root", "", nil, 60,
+			"root", "", nil, userMgmtTimeout(),
 		)
 		if exitCode != 0 {
 			return exitCode, result
@@ -483,6 +560,12 @@ func (cr *CommandRunner) delGroup() (exitCode int, result string) {
 	return 0, "Successfully deleted the group."
 }
 
+// userMgmtTimeout returns the timeout for the commands managing users and
+// groups.
+func userMgmtTimeout() time.Duration {
+	return config.GlobalSettings().UserMgmtTimeout
+}
+
 func (cr *CommandRunner) runFileUpload(fileName string) (exitCode int, result string) {
 	log.Debug().Msgf("Uploading file to %s. (username: %s, groupname: %s)", fileName, cr.data.Username, cr.data.Groupname)
 
@@ -538,7 +621,7 @@ func (cr *CommandRunner) runFileUpload(fileName string) (exitCode int, result st
 
 	contentType := writer.FormDataContentType()
 
-	_, statusCode, err := cr.wsClient.apiSession.MultipartRequest(cr.data.Content, requestBody, contentType, 600)
+	_, statusCode, err := cr.wsClient.apiSession.MultipartRequest(cr.data.Content, requestBody, contentType, 10*time.Minute)
 	if err != nil {
 		return 1, err.Error()
 	}
@@ -594,6 +677,11 @@ func (cr *CommandRunner) validateData(data interface{}) error {
 	return nil
 }
 
+var (
+	ftpWorkers   = make(map[*ftpWorker]struct{})
+	ftpWorkersMu sync.Mutex
+)
+
 func (cr *CommandRunner) openFtp(data openFtpData) error {
 	sysProcAttr, err := demote(data.Username, data.Groupname)
 	if err != nil {
@@ -609,16 +697,35 @@ func (cr *CommandRunner) openFtp(data openFtpData) error {
 		return fmt.Errorf("openftp: Failed to get executable path. %w", err)
 	}
 
+	settings := config.GlobalSettings()
 	cmd := exec.Command(
 		executable,
 		"ftp",
 		data.URL,
-		config.GlobalSettings.ServerURL,
+		settings.ServerURL,
 		data.HomeDirectory,
 	)
+	stdin, err := json.Marshal(FtpWorkerOptions{
+		MaxListDepth: settings.FtpMaxListDepth,
+		PingInterval: settings.PingInterval,
+		PongTimeout:  settings.PongTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("openftp: Failed to encode worker options. %w", err)
+	}
+
+	relay, err := newFtpRelay(settings.ServerURL + data.URL)
+	if err != nil {
+		return fmt.Errorf("openftp: Failed to set up the connection relay. %w", err)
+	}
+	// The worker holds its own copy once started.
+	defer func() { _ = relay.Close() }()
+
 	cmd.SysProcAttr = sysProcAttr
+	cmd.Stdin = bytes.NewReader(stdin)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{relay}
 
 	if err = cmd.Start(); err != nil {
 		log.Debug().Err(err).Msg("Failed to start ftp worker process")
@@ -626,9 +733,49 @@ func (cr *CommandRunner) openFtp(data openFtpData) error {
 		return fmt.Errorf("openftp: Failed to start ftp worker process. %w", err)
 	}
 
+	worker := &ftpWorker{cmd: cmd, done: make(chan struct{})}
+	ftpWorkersMu.Lock()
+	ftpWorkers[worker] = struct{}{}
+	ftpWorkersMu.Unlock()
+
+	// Reap the worker once its session ends.
+	go func() {
+		_ = cmd.Wait()
+		ftpWorkersMu.Lock()
+		delete(ftpWorkers, worker)
+		ftpWorkersMu.Unlock()
+		close(worker.done)
+	}()
+
 	return nil
 }
 
+// StopFtpWorkers asks the running ftp workers to close their sessions and
+// reaps them, killing the ones still running after timeout.
+func StopFtpWorkers(timeout time.Duration) {
+	ftpWorkersMu.Lock()
+	workers := make([]*ftpWorker, 0, len(ftpWorkers))
+	for worker := range ftpWorkers {
+		workers = append(workers, worker)
+	}
+	ftpWorkersMu.Unlock()
+
+	for _, worker := range workers {
+		_ = worker.cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	deadline := time.After(timeout)
+	for _, worker := range workers {
+		select {
+		case <-worker.done:
+		case <-deadline:
+			log.Warn().Msgf("ftp worker %d did not exit in time, killing it.", worker.cmd.Process.Pid)
+			_ = worker.cmd.Process.Kill()
+			<-worker.done
+		}
+	}
+}
+
 func getFileData(data CommandData) ([]byte, error) {
 	var content []byte
 	switch data.Type {
@@ -643,17 +790,20 @@ func getFileData(data CommandData) ([]byte, error) {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
 
-		parsedServerURL, err := url.Parse(config.GlobalSettings.ServerURL)
+		settings := config.GlobalSettings()
+		parsedServerURL, err := url.Parse(settings.ServerURL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse url: %w", err)
 		}
 
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = scheduler.CurrentProxyOptions().ProxyFunc()
+		client := http.Client{Transport: transport}
 		if parsedRequestURL.Host == parsedServerURL.Host && parsedRequestURL.Scheme == parsedServerURL.Scheme {
 			req.Header.Set("Authorization", fmt.Sprintf(`id="%s", key="%s"`,
-				config.GlobalSettings.ID, config.GlobalSettings.Key))
+				settings.ID, settings.Key))
+			client.Transport = scheduler.NewTransport()
 		}
-
-		client := http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
 			return nil, fmt.Errorf("failed to download content from URL: %w", err)
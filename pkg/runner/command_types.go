@@ -1,11 +1,17 @@
 package runner
 
-import "gopkg.in/go-playground/validator.v9"
+import (
+	"context"
+	"os/exec"
+
+	"gopkg.in/go-playground/validator.v9"
+)
 
 type Content struct {
 	Query   string  `json:"query"`
 	Command Command `json:"command,omitempty"`
 	Reason  string  `json:"reason,omitempty"`
+	Key     string  `json:"key,omitempty"` // new server key, for rotatekey
 }
 
 type Command struct {
@@ -45,6 +51,7 @@ type CommandData struct {
 	Paths         []string `json:"paths"`
 	Files         []File   `json:"files,omitempty"`
 	Keys          []string `json:"keys"`
+	Key           string   `json:"key"`
 }
 
 type CommandRunner struct {
@@ -53,6 +60,15 @@ type CommandRunner struct {
 	wsClient  *WebsocketClient
 	data      CommandData
 	validator *validator.Validate
+	ctx       context.Context // cancelled by a cancel query
+	cancel    context.CancelFunc
+	output    *outputStream // nil for commands without an ID
+}
+
+// ftpWorker is a running ftp worker process spawned by openftp.
+type ftpWorker struct {
+	cmd  *exec.Cmd
+	done chan struct{} // closed once the process has been reaped
 }
 
 // Structs defining the required input data for command validation purposes. //
@@ -98,8 +114,34 @@ type openFtpData struct {
 	HomeDirectory string `validate:"required"`
 }
 
+type commandAck struct {
+	QueuePosition int `json:"queue_position"` // 0 if the command started right away
+}
+
+// Status of a finished command, as reported in commandFin.
+const (
+	commandSucceeded = "success"
+	commandFailed    = "failed"
+	commandCancelled = "cancelled"
+)
+
+// commandFin reports a finished command. Result is what older Alpacon
+// versions show, the command's stdout or the error it failed with, while the
+// fields after it carry the details.
 type commandFin struct {
 	Success     bool    `json:"success"`
+	Status      string  `json:"status"`
 	Result      string  `json:"result"`
 	ElapsedTime float64 `json:"elapsed_time"`
+	ExitCode    int     `json:"exit_code"` // -1 if killed by a signal or never run
+	Signal      string  `json:"signal,omitempty"`
+	Stdout      string  `json:"stdout"`
+	Stderr      string  `json:"stderr"`
+	Output      string  `json:"output"` // stdout and stderr interleaved
+	// The output streamed to eventCommandOutputURL, so Alpacon can tell when
+	// all of it has arrived.
+	OutputChunks int   `json:"output_chunks"`
+	OutputBytes  int64 `json:"output_bytes"`
+	// Bytes written past tuning.command_stream_limit, which were not streamed.
+	OutputTruncated int64 `json:"output_truncated"`
 }
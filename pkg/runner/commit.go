@@ -154,7 +154,7 @@ func syncSystemInfo(session *scheduler.Session, keys []string) {
 			continue
 		}
 
-		resp, statusCode, err := session.Get(utils.JoinPath(entry.URL, entry.URLSuffix), 10)
+		resp, statusCode, err := session.Get(utils.JoinPath(entry.URL, entry.URLSuffix), 10*time.Second)
 		if statusCode == http.StatusOK {
 			err = json.Unmarshal(resp, &remoteData)
 			if err != nil {
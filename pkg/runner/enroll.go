@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alpacanetworks/alpamon-go/pkg/utils"
+)
+
+const (
+	enrollURL     = "/api/servers/enroll/"
+	enrollTimeout = 30 * time.Second
+)
+
+type enrollRequest struct {
+	Token string      `json:"token"`
+	Facts *commitData `json:"facts"`
+}
+
+type enrollResponse struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// Enroll registers this server to Alpacon at serverURL with a one-time
+// token, sending the same host facts as a commit, and returns the server
+// ID and key issued for it.
+func Enroll(serverURL, token string, transport http.RoundTripper) (id, key string, err error) {
+	body, err := json.Marshal(enrollRequest{
+		Token: token,
+		Facts: collectData(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, utils.JoinPath(serverURL, enrollURL), bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Transport: transport, Timeout: enrollTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to reach %s: %w", serverURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if !utils.IsSuccessStatusCode(resp.StatusCode) {
+		return "", "", fmt.Errorf("enrollment was rejected with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var enrolled enrollResponse
+	err = json.Unmarshal(respBody, &enrolled)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse enrollment response: %w", err)
+	}
+	if enrolled.ID == "" || enrolled.Key == "" {
+		return "", "", errors.New("enrollment response does not contain an id and key")
+	}
+
+	return enrolled.ID, enrolled.Key, nil
+}
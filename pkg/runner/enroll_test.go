@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnroll(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, enrollURL, r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var req enrollRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Token != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"detail":"invalid token"}`))
+			return
+		}
+		assert.NotNil(t, req.Facts, "Host facts should be sent along.")
+
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":"7a1bd5a4","key":"secret"}`))
+	}))
+	defer server.Close()
+
+	id, key, err := Enroll(server.URL, "token", http.DefaultTransport)
+	require.NoError(t, err)
+	assert.Equal(t, "7a1bd5a4", id)
+	assert.Equal(t, "secret", key)
+
+	_, _, err = Enroll(server.URL, "spent", http.DefaultTransport)
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestEnrollRejectsIncompleteResponse(t *testing.T) {
+	for _, body := range []string{`{"id":"7a1bd5a4"}`, `{"key":"secret"}`, `{"id":"7a1bd5a4","key":"secret"`} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+
+		_, _, err := Enroll(server.URL, "token", http.DefaultTransport)
+		if assert.Error(t, err, body) {
+			assert.NotContains(t, err.Error(), "secret", "The key must never end up in the error.")
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,254 @@
+package runner
+
+import (
+	"errors"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Commands in the same lane never run at the same time: package managers
+// fight over their locks, and user and group tools race on /etc/passwd and
+// /etc/group. Commands without a lane only wait for a free worker.
+const (
+	lanePackage = "package"
+	laneUser    = "user"
+)
+
+var (
+	errBacklogFull    = errors.New("too many commands are waiting to run, try again later")
+	errExecutorClosed = errors.New("alpamon is shutting down")
+)
+
+// immediateCommands are internal commands that answer at once or only spawn
+// a session. They bypass the workers, so a terminal can still be opened
+// while long commands keep every worker busy.
+var immediateCommands = map[string]bool{
+	"ping":      true,
+	"debug":     true,
+	"help":      true,
+	"openpty":   true,
+	"openftp":   true,
+	"resizepty": true,
+	"restart":   true,
+	"quit":      true,
+}
+
+var internalLanes = map[string]string{
+	"upgrade":  lanePackage,
+	"update":   lanePackage,
+	"adduser":  laneUser,
+	"addgroup": laneUser,
+	"deluser":  laneUser,
+	"delgroup": laneUser,
+}
+
+var programLanes = map[string]string{
+	"apt":      lanePackage,
+	"apt-get":  lanePackage,
+	"aptitude": lanePackage,
+	"dpkg":     lanePackage,
+	"yum":      lanePackage,
+	"dnf":      lanePackage,
+	"rpm":      lanePackage,
+	"zypper":   lanePackage,
+	"apk":      lanePackage,
+	"brew":     lanePackage,
+	"snap":     lanePackage,
+	"useradd":  laneUser,
+	"usermod":  laneUser,
+	"userdel":  laneUser,
+	"groupadd": laneUser,
+	"groupmod": laneUser,
+	"groupdel": laneUser,
+	"adduser":  laneUser,
+	"deluser":  laneUser,
+	"addgroup": laneUser,
+	"delgroup": laneUser,
+	"passwd":   laneUser,
+	"chpasswd": laneUser,
+	"gpasswd":  laneUser,
+}
+
+type queuedCommand struct {
+	runner *CommandRunner
+	lane   string
+}
+
+// commandExecutor runs commands on a bounded number of workers, as set by
+// tuning.command_workers. Commands that find every worker or their lane
+// busy wait in a backlog of at most tuning.command_backlog entries, and are
+// started in the order they arrived.
+type commandExecutor struct {
+	mu      sync.Mutex
+	running int                       // commands holding a worker
+	busy    map[string]bool           // lanes with a running command
+	active  map[string]*CommandRunner // started commands by ID
+	backlog []queuedCommand
+	closed  bool
+	wg      sync.WaitGroup // every started command, immediate ones included
+	run     func(*CommandRunner)
+}
+
+func newCommandExecutor() *commandExecutor {
+	return &commandExecutor{
+		busy:   make(map[string]bool),
+		active: make(map[string]*CommandRunner),
+		run:    (*CommandRunner).Run,
+	}
+}
+
+// submit starts runner, or queues it if it has to wait. ack is called with
+// the queue position before the command can start, 0 meaning it starts
+// right away, so the acknowledgement is always posted before the result.
+func (e *commandExecutor) submit(runner *CommandRunner, ack func(position int)) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return errExecutorClosed
+	}
+
+	lane, immediate := commandLane(runner.command)
+	if immediate {
+		ack(0)
+		e.start(queuedCommand{runner: runner}, false)
+		return nil
+	}
+
+	// The worker count may have been raised by a reload.
+	e.dispatch()
+
+	// Everything still in the backlog is blocked, so nothing queued in the
+	// same lane is skipped by starting right away.
+	if e.running < config.GlobalSettings().CommandWorkers && !e.busy[lane] {
+		ack(0)
+		e.start(queuedCommand{runner: runner, lane: lane}, true)
+		return nil
+	}
+
+	if len(e.backlog) >= config.GlobalSettings().CommandBacklog {
+		return errBacklogFull
+	}
+	e.backlog = append(e.backlog, queuedCommand{runner: runner, lane: lane})
+	ack(len(e.backlog))
+	return nil
+}
+
+// start runs queued in a goroutine. Commands holding a worker occupy their
+// lane until they finish. It must be called with mu held.
+func (e *commandExecutor) start(queued queuedCommand, worker bool) {
+	if worker {
+		e.running++
+		if queued.lane != "" {
+			e.busy[queued.lane] = true
+		}
+	}
+	if id := queued.runner.command.ID; id != "" {
+		e.active[id] = queued.runner
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.run(queued.runner)
+		e.finish(queued, worker)
+	}()
+}
+
+func (e *commandExecutor) finish(queued queuedCommand, worker bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.active, queued.runner.command.ID)
+	if worker {
+		e.running--
+		delete(e.busy, queued.lane)
+		e.dispatch()
+	}
+}
+
+// cancel cancels the command with the given ID and reports whether it was
+// found. A running command has its context cancelled, while a waiting one
+// is taken out of the backlog and returned, as it will never run.
+func (e *commandExecutor) cancel(id string) (dropped *CommandRunner, found bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if runner, ok := e.active[id]; ok {
+		runner.cancel()
+		return nil, true
+	}
+
+	for i, queued := range e.backlog {
+		if queued.runner.command.ID == id {
+			e.backlog = append(e.backlog[:i], e.backlog[i+1:]...)
+			return queued.runner, true
+		}
+	}
+	return nil, false
+}
+
+// dispatch starts the oldest waiting commands whose lanes are free, as long
+// as workers are available. It must be called with mu held.
+func (e *commandExecutor) dispatch() {
+	for i := 0; i < len(e.backlog) && e.running < config.GlobalSettings().CommandWorkers; {
+		queued := e.backlog[i]
+		if queued.lane != "" && e.busy[queued.lane] {
+			i++
+			continue
+		}
+		e.backlog = append(e.backlog[:i], e.backlog[i+1:]...)
+		e.start(queued, true)
+	}
+}
+
+// close stops accepting commands and returns the ones still waiting, which
+// will never run.
+func (e *commandExecutor) close() []*CommandRunner {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.closed = true
+	dropped := make([]*CommandRunner, 0, len(e.backlog))
+	for _, queued := range e.backlog {
+		dropped = append(dropped, queued.runner)
+	}
+	e.backlog = nil
+	return dropped
+}
+
+// commandLane tells which lane command runs in, or whether it bypasses the
+// workers. A shell line is put in the lane of the first program in it that
+// has one, looking past sudo and the command separators.
+func commandLane(command Command) (lane string, immediate bool) {
+	switch command.Shell {
+	case "internal":
+		fields := strings.Fields(command.Line)
+		if len(fields) == 0 {
+			return "", true
+		}
+		return internalLanes[fields[0]], immediateCommands[fields[0]]
+	case "system":
+		first := true
+		for _, field := range strings.Fields(command.Line) {
+			switch field {
+			case "&&", "||", ";", "|":
+				first = true
+				continue
+			case "sudo":
+				continue
+			}
+			if first {
+				if lane, ok := programLanes[filepath.Base(field)]; ok {
+					return lane, false
+				}
+				first = false
+			}
+		}
+		return "", false
+	default:
+		return "", true
+	}
+}
@@ -0,0 +1,125 @@
+package runner
+
+import (
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/alpacanetworks/alpamon-go/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestExecutor returns an executor whose commands block until released,
+// and a channel receiving the line of each command as it starts.
+func newTestExecutor(t *testing.T, workers, backlog int) (*commandExecutor, chan string, func()) {
+	previous := *config.GlobalSettings()
+	config.UpdateSettings(func(settings *config.Settings) {
+		settings.CommandWorkers = workers
+		settings.CommandBacklog = backlog
+	})
+	t.Cleanup(func() { config.InitSettings(previous) })
+
+	started := make(chan string, 16)
+	release := make(chan struct{})
+	var once sync.Once
+
+	executor := newCommandExecutor()
+	executor.run = func(runner *CommandRunner) {
+		started <- runner.command.Line
+		<-release
+	}
+	return executor, started, func() { once.Do(func() { close(release) }) }
+}
+
+func submitLine(t *testing.T, executor *commandExecutor, shell, line string) int {
+	position := -1
+	err := executor.submit(&CommandRunner{command: Command{Shell: shell, Line: line}}, func(p int) {
+		position = p
+	})
+	require.NoError(t, err)
+	return position
+}
+
+func receive(t *testing.T, started chan string) string {
+	select {
+	case line := <-started:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("No command started.")
+		return ""
+	}
+}
+
+func TestExecutorSerializesLanes(t *testing.T) {
+	executor, started, release := newTestExecutor(t, 4, 10)
+	defer release()
+
+	assert.Equal(t, 0, submitLine(t, executor, "system", "sudo apt-get install -y curl"))
+	assert.Equal(t, 1, submitLine(t, executor, "internal", "update"), "Package managers must not run concurrently.")
+	assert.Equal(t, 0, submitLine(t, executor, "internal", "adduser"))
+	assert.Equal(t, 2, submitLine(t, executor, "system", "id alice && /usr/sbin/usermod -aG sudo alice"))
+	assert.Equal(t, 0, submitLine(t, executor, "system", "uptime"))
+	assert.Equal(t, 0, submitLine(t, executor, "internal", "ping"), "Immediate commands should bypass the workers.")
+
+	assert.ElementsMatch(t, []string{"sudo apt-get install -y curl", "adduser", "uptime", "ping"},
+		[]string{receive(t, started), receive(t, started), receive(t, started), receive(t, started)})
+
+	release()
+	assert.ElementsMatch(t, []string{"update", "id alice && /usr/sbin/usermod -aG sudo alice"},
+		[]string{receive(t, started), receive(t, started)})
+	assert.True(t, utils.WaitTimeout(&executor.wg, time.Second))
+}
+
+func TestExecutorBoundsBacklog(t *testing.T) {
+	executor, started, release := newTestExecutor(t, 1, 2)
+	defer release()
+
+	assert.Equal(t, 0, submitLine(t, executor, "system", "uptime"))
+	assert.Equal(t, 1, submitLine(t, executor, "system", "hostname"))
+	assert.Equal(t, 2, submitLine(t, executor, "system", "whoami"))
+
+	err := executor.submit(&CommandRunner{command: Command{Shell: "system", Line: "date"}}, func(int) {
+		t.Error("Rejected commands should not be acknowledged with a position.")
+	})
+	assert.ErrorIs(t, err, errBacklogFull)
+	assert.Equal(t, "uptime", receive(t, started))
+
+	dropped := executor.close()
+	require.Len(t, dropped, 2)
+	assert.Equal(t, "hostname", dropped[0].command.Line)
+
+	err = executor.submit(&CommandRunner{command: Command{Shell: "internal", Line: "ping"}}, func(int) {})
+	assert.ErrorIs(t, err, errExecutorClosed)
+}
+
+func TestExecutorCancel(t *testing.T) {
+	executor, started, release := newTestExecutor(t, 1, 10)
+	defer release()
+
+	running := NewCommandRunner(nil, Command{ID: "running", Shell: "system", Line: "uptime"}, CommandData{})
+	waiting := NewCommandRunner(nil, Command{ID: "waiting", Shell: "system", Line: "hostname"}, CommandData{})
+	require.NoError(t, executor.submit(running, func(int) {}))
+	require.NoError(t, executor.submit(waiting, func(int) {}))
+	assert.Equal(t, "uptime", receive(t, started))
+
+	dropped, found := executor.cancel("waiting")
+	assert.True(t, found)
+	assert.Same(t, waiting, dropped, "A waiting command should be taken out of the backlog.")
+
+	dropped, found = executor.cancel("running")
+	assert.True(t, found)
+	assert.Nil(t, dropped)
+	assert.Error(t, running.ctx.Err(), "A running command should have its context cancelled.")
+
+	_, found = executor.cancel("unknown")
+	assert.False(t, found)
+
+	release()
+	assert.True(t, utils.WaitTimeout(&executor.wg, time.Second))
+	select {
+	case line := <-started:
+		t.Fatalf("The dropped command %q should never run.", line)
+	default:
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/alpacanetworks/alpamon-go/pkg/logger"
 	"github.com/gorilla/websocket"
@@ -20,6 +23,7 @@ type FtpClient struct {
 	url              string
 	homeDirectory    string
 	workingDirectory string
+	options          FtpWorkerOptions
 	log              logger.FtpLogger
 }
 
@@ -28,11 +32,18 @@ func NewFtpClient(data FtpConfigData) *FtpClient {
 		"Origin": {data.ServerURL},
 	}
 
+	// The worker talks plain websocket to alpamon, which relays it over TLS.
+	url := data.ServerURL + data.URL
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		url = "ws://" + rest
+	}
+
 	return &FtpClient{
 		requestHeader:    headers,
-		url:              strings.Replace(data.ServerURL, "http", "ws", 1) + data.URL,
+		url:              url,
 		homeDirectory:    data.HomeDirectory,
 		workingDirectory: data.HomeDirectory,
+		options:          data.Options,
 		log:              data.Logger,
 	}
 }
@@ -40,17 +51,38 @@ func NewFtpClient(data FtpConfigData) *FtpClient {
 func (fc *FtpClient) RunFtpBackground() {
 	fc.log.Debug().Msg("Opening websocket for ftp session.")
 
-	var err error
-	fc.conn, _, err = websocket.DefaultDialer.Dial(fc.url, fc.requestHeader)
+	// alpamon passes the relay socket, see runner.newFtpRelay.
+	relay := os.NewFile(ftpRelayFd, "relay")
+	conn, err := net.FileConn(relay)
+	_ = relay.Close()
+	if err != nil {
+		fc.log.Debug().Err(err).Msg("Failed to open the connection relayed by alpamon")
+		return
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = nil
+	dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+		return conn, nil
+	}
+
+	fc.conn, _, err = dialer.Dial(fc.url, fc.requestHeader)
 	if err != nil {
 		fc.log.Debug().Err(err).Msgf("Failed to connect to pty websocket at %s", fc.url)
 		return
 	}
 	defer fc.close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// alpamon sends SIGTERM when it shuts down, so that the session is closed cleanly.
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
+	pingInterval, pongTimeout := defaultPingInterval, defaultPongTimeout
+	if fc.options.PingInterval > 0 && fc.options.PongTimeout > 0 {
+		pingInterval, pongTimeout = fc.options.PingInterval, fc.options.PongTimeout
+	}
+	keepAlive(ctx, fc.conn, pingInterval, pongTimeout)
+
 	go fc.read(ctx, cancel)
 
 	<-ctx.Done()
@@ -174,8 +206,17 @@ func (fc *FtpClient) list(rootDir string, depth int) (CommandResult, error) {
 	return cmdResult, err
 }
 
+// maxListDepth returns the depth limit passed by alpamon, or the default
+// when started by an older version.
+func (fc *FtpClient) maxListDepth() int {
+	if fc.options.MaxListDepth > 0 {
+		return fc.options.MaxListDepth
+	}
+	return defaultMaxListDepth
+}
+
 func (fc *FtpClient) listRecursive(path string, depth, current int) (CommandResult, error) {
-	if depth > 3 {
+	if depth > fc.maxListDepth() {
 		return CommandResult{
 			Message: ErrTooLargeDepth,
 		}, fmt.Errorf("%s", ErrTooLargeDepth)
@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ftpRelayFd is the descriptor of the relay socket in the ftp worker, the
+// first of its extra files.
+const ftpRelayFd = 3
+
+// newFtpRelay returns the worker's end of a socket pair whose other end
+// alpamon connects to target. The ftp worker runs demoted, so the user it
+// runs as could read its memory, and it is never given the client key or
+// the proxy credentials. It speaks plain websocket over the socket instead,
+// while alpamon sends its handshake over its own TLS connection to Alpacon,
+// through the proxy if any, and copies the bytes both ways from then on.
+func newFtpRelay(target string) (*os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "ftp relay")
+	conn, err := net.FileConn(local)
+	_ = local.Close()
+	if err != nil {
+		_ = unix.Close(fds[1])
+		return nil, err
+	}
+
+	go relayFtp(conn, target, scheduler.NewTransport())
+
+	return os.NewFile(uintptr(fds[1]), "ftp worker relay"), nil
+}
+
+// relayFtp sends the websocket handshake read from conn to target, which
+// the worker has no say in, then copies the connection both ways until
+// either side closes it.
+func relayFtp(conn net.Conn, target string, transport *http.Transport) {
+	defer func() { _ = conn.Close() }()
+	defer transport.CloseIdleConnections()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read the handshake of the ftp worker.")
+		return
+	}
+	if req.Method != http.MethodGet || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		log.Warn().Msgf("Ftp worker sent %s %s instead of a websocket handshake.", req.Method, req.RequestURI)
+		return
+	}
+
+	upstream, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to build the ftp handshake for %s.", target)
+		return
+	}
+	upstream.Header = req.Header.Clone()
+
+	resp, err := transport.RoundTrip(upstream)
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to connect ftp session to %s.", target)
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		_ = resp.Write(conn)
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(conn)
+	}
+	if err == nil {
+		_, err = io.WriteString(conn, "\r\n")
+	}
+	if err != nil {
+		return
+	}
+
+	// Returning closes both connections, which ends the other copy.
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(body, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, body)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRelayFtp(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ws/ftp/session/", r.URL.Path, "The worker should not pick where it connects to.")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = conn.WriteMessage(messageType, message)
+		}
+	}))
+	defer server.Close()
+
+	worker, local := net.Pipe()
+	go relayFtp(local, server.URL+"/ws/ftp/session/", server.Client().Transport.(*http.Transport).Clone())
+
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = nil
+	dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+		return worker, nil
+	}
+	conn, _, err := dialer.Dial("ws://alpacon.example.com/ws/other/", nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"command":"pwd"}`)))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"command":"pwd"}`, string(message))
+}
+
+func TestRelayFtpRejectsPlainRequests(t *testing.T) {
+	worker, local := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relayFtp(local, "https://alpacon.example.com/ws/ftp/session/", &http.Transport{})
+		close(done)
+	}()
+
+	_, err := worker.Write([]byte("GET /api/servers/ HTTP/1.1\r\nHost: alpacon.example.com\r\n\r\n"))
+	require.NoError(t, err)
+	<-done
+
+	_, err = worker.Read(make([]byte, 1))
+	assert.Error(t, err, "The relay should hang up on anything but a websocket handshake.")
+}
@@ -30,13 +30,26 @@ const (
 	ErrDirectoryNotEmpty     = "directory not empty"
 )
 
+const defaultMaxListDepth = 3
+
 type FtpConfigData struct {
 	URL           string
 	ServerURL     string
 	HomeDirectory string
+	Options       FtpWorkerOptions
 	Logger        logger.FtpLogger
 }
 
+// FtpWorkerOptions holds the settings handed to the ftp worker on its
+// standard input. The worker runs demoted and cannot read the config itself.
+// It connects through alpamon, see newFtpRelay, so no credentials are among
+// them.
+type FtpWorkerOptions struct {
+	MaxListDepth int           `json:"max_list_depth,omitempty"`
+	PingInterval time.Duration `json:"ping_interval,omitempty"`
+	PongTimeout  time.Duration `json:"pong_timeout,omitempty"`
+}
+
 type FtpData struct {
 	Path      string `json:"path,omitempty"`
 	Depth     int    `json:"depth,omitempty"`
@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync"
+	"time"
+)
+
+// The ftp worker falls back to these if alpamon does not pass its settings.
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 10 * time.Second
+)
+
+// keepAlive pings the peer of conn every interval until ctx is done or the
+// connection is closed. The read deadline is pushed back whenever a pong
+// arrives, so if the peer stops answering, e.g. because a NAT mapping was
+// silently dropped, the pending read fails within pongTimeout of a ping and
+// the caller can reconnect or close the session.
+//
+// Once ctx is done, the pending read fails right away, so the goroutine
+// reading conn can close it itself.
+//
+// It must be called before conn is read from.
+func keepAlive(ctx context.Context, conn *websocket.Conn, interval, pongTimeout time.Duration) {
+	// Keeps a late pong from pushing back the deadline set on cancellation.
+	var mu sync.Mutex
+	extend := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			return nil
+		}
+		return conn.SetReadDeadline(time.Now().Add(interval + pongTimeout))
+	}
+	_ = extend()
+	context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	conn.SetPongHandler(func(string) error {
+		return extend()
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// WriteControl may be used concurrently with the other writes.
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongTimeout))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// isPongTimeout reports whether a read failed because no pong arrived in time.
+func isPongTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
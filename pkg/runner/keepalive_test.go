@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newKeepAliveServer starts a websocket server that keeps reading, and
+// answers pings only if answer is set.
+func newKeepAliveServer(t *testing.T, answer bool) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		if !answer {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestKeepAliveDetectsDeadPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := newKeepAliveServer(t, false)
+	keepAlive(ctx, conn, 50*time.Millisecond, 50*time.Millisecond)
+
+	start := time.Now()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, isPongTimeout(err), "Read should fail once pongs are missed, got %v", err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestKeepAliveKeepsAnsweringPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := newKeepAliveServer(t, true)
+	keepAlive(ctx, conn, 50*time.Millisecond, 50*time.Millisecond)
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		t.Fatalf("Read should block while pongs arrive, got %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestKeepAliveUnblocksReadWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := newKeepAliveServer(t, true)
+	keepAlive(ctx, conn, time.Minute, time.Minute)
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		read <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-read:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read should fail once the context is done.")
+	}
+	assert.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")),
+		"The connection should stay open for the close frame.")
+}
@@ -0,0 +1,275 @@
+package runner
+
+import (
+	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	eventCommandOutputURL = "/api/events/commands/%s/output/"
+
+	outputChunkSize     = 16 * 1024
+	outputFlushInterval = 1 * time.Second
+	// Chunks go before logs but make way for acks and fins when the
+	// request queue is full.
+	outputPriority = 20
+
+	// finShares is the number of fields of a fin that share
+	// tuning.command_output_limit: the result, stdout, stderr and the two
+	// interleaved, so a fin stays within the limit as a whole.
+	finShares = 4
+)
+
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+)
+
+type commandOutput struct {
+	Seq       int       `json:"seq"` // starting from 0, per command
+	Stream    string    `json:"stream"`
+	Data      string    `json:"data"`
+	Timestamp time.Time `json:"timestamp"` // when the first byte of data was written
+}
+
+// outputStream sends what a command writes to Alpacon in chunks while it
+// runs. A chunk holds the output of one stream and is sent once it is full,
+// when the other stream is written to, or outputFlushInterval after its
+// first byte, so the output keeps its order and slow commands still show
+// progress. At most tuning.command_stream_limit bytes are streamed, so a
+// chatty command cannot crowd out other requests to Alpacon. The end of the
+// output and how the last process exited are kept for the fin. A nil
+// outputStream discards everything.
+type outputStream struct {
+	mu        sync.Mutex
+	url       string
+	seq       int   // of the next chunk
+	bytes     int64 // streamed
+	budget    int64 // bytes that may still be streamed
+	truncated int64 // bytes written past the budget
+	pending   []byte
+	stream    string    // of the pending output
+	since     time.Time // when the pending output started
+	timer     *time.Timer
+	stdout    *tailBuffer
+	stderr    *tailBuffer
+	combined  *tailBuffer // stdout and stderr interleaved
+	share     int         // bytes each field of the fin may hold
+	signal    string      // that killed the last process, if any
+	post      func(url string, chunk *commandOutput)
+}
+
+func newOutputStream(commandID string) *outputStream {
+	settings := config.GlobalSettings()
+	share := max(settings.CommandOutputLimit/finShares, 1)
+
+	return &outputStream{
+		url:      fmt.Sprintf(eventCommandOutputURL, commandID),
+		budget:   int64(settings.CommandStreamLimit),
+		stdout:   newTailBuffer(share),
+		stderr:   newTailBuffer(share),
+		combined: newTailBuffer(share),
+		share:    share,
+		post: func(url string, chunk *commandOutput) {
+			scheduler.Rqueue.Post(url, chunk, outputPriority, time.Time{})
+		},
+	}
+}
+
+// writer returns a writer for the named stream.
+func (s *outputStream) writer(stream string) io.Writer {
+	if s == nil {
+		return io.Discard
+	}
+	return &streamWriter{output: s, stream: stream}
+}
+
+type streamWriter struct {
+	output *outputStream
+	stream string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.output.write(w.stream, p)
+	return len(p), nil
+}
+
+func (s *outputStream) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stream != s.stream {
+		s.flush(true)
+	}
+	s.stream = stream
+
+	_, _ = s.combined.Write(p)
+	if stream == stderrStream {
+		_, _ = s.stderr.Write(p)
+	} else {
+		_, _ = s.stdout.Write(p)
+	}
+
+	if int64(len(p)) > s.budget {
+		n := completeRunes(p[:s.budget])
+		s.truncated += int64(len(p) - n)
+		s.budget = 0
+		p = p[:n]
+	} else {
+		s.budget -= int64(len(p))
+	}
+	s.bytes += int64(len(p))
+
+	for len(p) > 0 {
+		if len(s.pending) == 0 {
+			s.since = time.Now()
+		}
+		if s.timer == nil {
+			s.timer = time.AfterFunc(outputFlushInterval, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.flush(false)
+			})
+		}
+
+		n := min(len(p), outputChunkSize-len(s.pending))
+		s.pending = append(s.pending, p[:n]...)
+		p = p[n:]
+		if len(s.pending) == outputChunkSize {
+			s.flush(false)
+		}
+	}
+}
+
+// flush sends the pending output as a chunk. Unless all is set, a character
+// cut off at the end is held back until the rest of it is written, as the
+// JSON string carrying the chunk cannot hold a part of it. It must be called
+// with mu held.
+func (s *outputStream) flush(all bool) {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	n := len(s.pending)
+	if !all {
+		n = completeRunes(s.pending)
+	}
+	if n == 0 {
+		return
+	}
+
+	s.post(s.url, &commandOutput{
+		Seq:       s.seq,
+		Stream:    s.stream,
+		Data:      string(s.pending[:n]),
+		Timestamp: s.since,
+	})
+	s.seq++
+	s.pending = append([]byte(nil), s.pending[n:]...)
+	s.since = time.Now()
+}
+
+// completeRunes returns the length of b without a trailing incomplete UTF-8
+// sequence.
+func completeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// exited records how a process run for the command ended. state is nil if
+// the process could not be started.
+func (s *outputStream) exited(state *os.ProcessState) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signal = ""
+	if state == nil {
+		return
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		s.signal = unix.SignalName(status.Signal())
+	}
+}
+
+// finish sends what is still pending, so every chunk is queued before the
+// fin refers to it, and fills in the output of fin. Its result is cut down
+// to the same share of tuning.command_output_limit as the output.
+func (s *outputStream) finish(fin *commandFin) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush(true)
+	fin.OutputChunks = s.seq
+	fin.OutputBytes = s.bytes
+	fin.OutputTruncated = s.truncated
+	fin.Stdout = s.stdout.String()
+	fin.Stderr = s.stderr.String()
+	fin.Output = s.combined.String()
+	fin.Signal = s.signal
+
+	if len(fin.Result) > s.share {
+		result := newTailBuffer(s.share)
+		_, _ = result.Write([]byte(fin.Result))
+		fin.Result = result.String()
+	}
+}
+
+// tailBuffer keeps the last limit bytes written to it, so a command's result
+// stays bounded however much it prints.
+type tailBuffer struct {
+	limit   int
+	data    []byte
+	dropped int64
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	// Trimming only once twice the limit is held keeps copying linear.
+	if len(b.data) > 2*b.limit {
+		b.trim()
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) trim() {
+	if excess := len(b.data) - b.limit; excess > 0 {
+		b.dropped += int64(excess)
+		b.data = append(b.data[:0], b.data[excess:]...)
+	}
+}
+
+func (b *tailBuffer) String() string {
+	b.trim()
+	if b.dropped > 0 {
+		return fmt.Sprintf("[%d bytes of output omitted]\n%s", b.dropped, b.data)
+	}
+	return string(b.data)
+}
@@ -0,0 +1,138 @@
+package runner
+
+import (
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestOutputStream(t *testing.T) (*outputStream, func() []*commandOutput) {
+	previous := *config.GlobalSettings()
+	config.UpdateSettings(func(settings *config.Settings) {
+		settings.CommandOutputLimit = 1024 * 1024
+		settings.CommandStreamLimit = 4 * outputChunkSize
+	})
+	t.Cleanup(func() { config.InitSettings(previous) })
+
+	var mu sync.Mutex
+	var chunks []*commandOutput
+
+	output := newOutputStream("command")
+	output.post = func(url string, chunk *commandOutput) {
+		mu.Lock()
+		defer mu.Unlock()
+		chunks = append(chunks, chunk)
+	}
+	return output, func() []*commandOutput {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*commandOutput(nil), chunks...)
+	}
+}
+
+func TestOutputStreamChunks(t *testing.T) {
+	output, sent := newTestOutputStream(t)
+	stdout := output.writer(stdoutStream)
+	stderr := output.writer(stderrStream)
+
+	_, _ = stdout.Write([]byte("Reading package lists...\n"))
+	_, _ = stdout.Write([]byte("Building dependency tree...\n"))
+	_, _ = stderr.Write([]byte("W: some warning\n"))
+	_, _ = stdout.Write([]byte(strings.Repeat("x", outputChunkSize+1)))
+
+	var fin commandFin
+	output.finish(&fin)
+	assert.Equal(t, 4, fin.OutputChunks)
+	assert.EqualValues(t, 25+28+16+outputChunkSize+1, fin.OutputBytes)
+	assert.Equal(t, "W: some warning\n", fin.Stderr)
+	assert.True(t, strings.HasPrefix(fin.Stdout, "Reading package lists...\nBuilding dependency tree...\nxxx"))
+	assert.True(t, strings.HasPrefix(fin.Output, "Reading package lists...\nBuilding dependency tree...\nW: some warning\nxxx"),
+		"The interleaved output should keep the order of the writes.")
+
+	got := sent()
+	if assert.Len(t, got, 4) {
+		assert.Equal(t, "Reading package lists...\nBuilding dependency tree...\n", got[0].Data,
+			"Writes to the same stream should be sent together.")
+		assert.Equal(t, stderrStream, got[1].Stream)
+		assert.Len(t, got[2].Data, outputChunkSize)
+		assert.Equal(t, "x", got[3].Data)
+		for i, chunk := range got {
+			assert.Equal(t, i, chunk.Seq)
+			assert.False(t, chunk.Timestamp.IsZero())
+		}
+	}
+}
+
+func TestOutputStreamFlushesSlowOutput(t *testing.T) {
+	output, sent := newTestOutputStream(t)
+	defer output.finish(&commandFin{})
+
+	_, _ = output.writer(stdoutStream).Write([]byte("50%\n"))
+	assert.Eventually(t, func() bool { return len(sent()) == 1 }, 3*outputFlushInterval, 50*time.Millisecond,
+		"Pending output should be sent without waiting for more.")
+}
+
+func TestOutputStreamKeepsCharactersWhole(t *testing.T) {
+	output, sent := newTestOutputStream(t)
+	stdout := output.writer(stdoutStream)
+
+	// A three byte character cut off by the end of a chunk.
+	_, _ = stdout.Write([]byte(strings.Repeat("x", outputChunkSize-1) + "한"))
+	_, _ = stdout.Write([]byte("글"))
+	output.finish(&commandFin{})
+
+	got := sent()
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, strings.Repeat("x", outputChunkSize-1), got[0].Data)
+		assert.Equal(t, "한글", got[1].Data)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buffer := newTailBuffer(4)
+	for _, word := range []string{"one ", "two ", "three ", "four"} {
+		_, _ = buffer.Write([]byte(word))
+	}
+	assert.Equal(t, "[14 bytes of output omitted]\nfour", buffer.String())
+
+	buffer = newTailBuffer(10)
+	_, _ = buffer.Write([]byte("short"))
+	assert.Equal(t, "short", buffer.String())
+}
+
+func TestOutputStreamStopsAtBudget(t *testing.T) {
+	output, sent := newTestOutputStream(t)
+	stdout := output.writer(stdoutStream)
+
+	_, _ = stdout.Write([]byte(strings.Repeat("x", 3*outputChunkSize)))
+	_, _ = stdout.Write([]byte(strings.Repeat("y", 2*outputChunkSize)))
+	_, _ = output.writer(stderrStream).Write([]byte("error\n"))
+
+	var fin commandFin
+	output.finish(&fin)
+	assert.Equal(t, 4, fin.OutputChunks)
+	assert.EqualValues(t, 4*outputChunkSize, fin.OutputBytes)
+	assert.EqualValues(t, outputChunkSize+len("error\n"), fin.OutputTruncated)
+	assert.True(t, strings.HasSuffix(fin.Output, "yyyerror\n"), "The result should still hold the end of the output.")
+	assert.Len(t, sent(), 4)
+}
+
+func TestFinStaysWithinOutputLimit(t *testing.T) {
+	output, _ := newTestOutputStream(t)
+	limit := config.GlobalSettings().CommandOutputLimit
+
+	_, _ = output.writer(stdoutStream).Write([]byte(strings.Repeat("o", 2*limit)))
+	_, _ = output.writer(stderrStream).Write([]byte(strings.Repeat("e", limit)))
+
+	fin := commandFin{Result: strings.Repeat("o", limit)}
+	output.finish(&fin)
+
+	// Each field may start with a note of how much was left out.
+	size := len(fin.Result) + len(fin.Stdout) + len(fin.Stderr) + len(fin.Output)
+	assert.LessOrEqual(t, size, limit+finShares*64, "The fin as a whole should stay within the output limit.")
+	assert.True(t, strings.HasSuffix(fin.Result, "ooo"))
+	assert.True(t, strings.HasSuffix(fin.Output, "eee"), "The fin should hold the end of the output.")
+}
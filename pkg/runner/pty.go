@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/alpacanetworks/alpamon-go/pkg/scheduler"
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
@@ -15,6 +16,8 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PtyClient struct {
@@ -29,23 +32,59 @@ type PtyClient struct {
 	groupname     string
 	homeDirectory string
 	sessionID     string
+	cancel        context.CancelFunc
 }
 
-var terminals map[string]*PtyClient
+var (
+	terminals   map[string]*PtyClient
+	terminalsMu sync.Mutex
+)
+
+const terminalCloseInterval = 50 * time.Millisecond
 
 func init() {
 	terminals = make(map[string]*PtyClient)
 }
 
+func getTerminal(sessionID string) *PtyClient {
+	terminalsMu.Lock()
+	defer terminalsMu.Unlock()
+
+	return terminals[sessionID]
+}
+
+// CloseTerminals ends every open pty session, waiting at most timeout for
+// their shells to exit and their websockets to close.
+func CloseTerminals(timeout time.Duration) {
+	terminalsMu.Lock()
+	for _, pc := range terminals {
+		pc.cancel()
+	}
+	terminalsMu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		terminalsMu.Lock()
+		open := len(terminals)
+		terminalsMu.Unlock()
+		if open == 0 {
+			return
+		}
+		time.Sleep(terminalCloseInterval)
+	}
+	log.Warn().Msg("Some pty sessions did not close in time.")
+}
+
 func NewPtyClient(data CommandData) *PtyClient {
+	settings := config.GlobalSettings()
 	headers := http.Header{
-		"Authorization": {fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)},
-		"Origin":        {config.GlobalSettings.ServerURL},
+		"Authorization": {fmt.Sprintf(`id="%s", key="%s"`, settings.ID, settings.Key)},
+		"Origin":        {settings.ServerURL},
 	}
 
 	return &PtyClient{
 		requestHeader: headers,
-		url:           strings.Replace(config.GlobalSettings.ServerURL, "http", "ws", 1) + data.URL,
+		url:           strings.Replace(settings.ServerURL, "http", "ws", 1) + data.URL,
 		rows:          data.Rows,
 		cols:          data.Cols,
 		username:      data.Username,
@@ -56,10 +95,11 @@ func NewPtyClient(data CommandData) *PtyClient {
 }
 
 func (pc *PtyClient) RunPtyBackground() {
+	settings := config.GlobalSettings()
 	log.Debug().Msg("Opening websocket for pty session.")
 
 	var err error
-	pc.conn, _, err = websocket.DefaultDialer.Dial(pc.url, pc.requestHeader)
+	pc.conn, _, err = scheduler.NewDialer().Dial(pc.url, pc.requestHeader)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to connect to pty websocket at %s", pc.url)
 		return
@@ -90,6 +130,9 @@ func (pc *PtyClient) RunPtyBackground() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	pc.cancel = cancel
+
+	keepAlive(ctx, pc.conn, settings.PingInterval, settings.PongTimeout)
 
 	go func() {
 		pc.readFromWebsocket(ctx, cancel)
@@ -98,7 +141,9 @@ func (pc *PtyClient) RunPtyBackground() {
 		pc.readFromPTY(ctx, cancel)
 	}()
 
+	terminalsMu.Lock()
 	terminals[pc.sessionID] = pc
+	terminalsMu.Unlock()
 
 	<-ctx.Done()
 }
@@ -205,9 +250,11 @@ func (pc *PtyClient) close() {
 		_ = pc.conn.Close()
 	}
 
-	if terminals[pc.sessionID] != nil {
+	terminalsMu.Lock()
+	if terminals[pc.sessionID] == pc {
 		delete(terminals, pc.sessionID)
 	}
+	terminalsMu.Unlock()
 
 	log.Debug().Msg("Websocket connection for pty has been closed.")
 }
@@ -2,8 +2,11 @@ package runner
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
 	"github.com/rs/zerolog/log"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
@@ -56,7 +59,22 @@ func demote(username, groupname string) (*syscall.SysProcAttr, error) {
 	}, nil
 }
 
-func runCmd(args []string, username, groupname string, env map[string]string, timeout int) (exitCode int, result string) {
+// killGracePeriod is how long a cancelled or timed out command has to exit
+// after SIGTERM before its process group is killed.
+const killGracePeriod = 10 * time.Second
+
+// runCmd runs args in a process group of its own, so cancelling ctx or
+// running into timeout terminates everything the command spawned. Its
+// output is streamed to output while it runs, and the end of stdout, up to
+// tuning.command_output_limit, is returned along with the exit code, which
+// is -1 if the command was killed by a signal. A cancelled command returns
+// the output it produced so far, any other failure its error.
+func runCmd(ctx context.Context, output *outputStream, args []string, username, groupname string, env map[string]string, timeout time.Duration) (exitCode int, result string) {
+	// Later parts of a cancelled command line are not started at all.
+	if ctx.Err() != nil {
+		return 1, ""
+	}
+
 	if env != nil {
 		defaultEnv := getDefaultEnv()
 		for key, value := range defaultEnv {
@@ -79,13 +97,12 @@ func runCmd(args []string, username, groupname string, env map[string]string, ti
 		}
 	}
 
-	var ctx context.Context
 	var cancel context.CancelFunc
 
 	if timeout > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 	} else {
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(ctx)
 	}
 	defer cancel()
 
@@ -118,12 +135,52 @@ func runCmd(args []string, username, groupname string, env map[string]string, ti
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
 	}
 
-	output, err := cmd.Output()
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return signalGroup(cmd, syscall.SIGTERM)
+	}
+	// Past the grace period, Wait kills the command and stops waiting for
+	// children holding on to its output.
+	cmd.WaitDelay = killGracePeriod
+
+	stdout := newTailBuffer(config.GlobalSettings().CommandOutputLimit)
+	cmd.Stdout = io.MultiWriter(stdout, output.writer(stdoutStream))
+	cmd.Stderr = output.writer(stderrStream)
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		// Whatever survived SIGTERM, or the command itself, is killed.
+		_ = signalGroup(cmd, syscall.SIGKILL)
+	} else if errors.Is(err, exec.ErrWaitDelay) && cmd.ProcessState.Success() {
+		// The command succeeded, only something it left running in the
+		// background kept its output open.
+		err = nil
+	}
+	output.exited(cmd.ProcessState)
+
 	if err != nil {
-		return 1, err.Error()
+		exitCode = 1
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return exitCode, stdout.String()
+		}
+		return exitCode, err.Error()
 	}
 
-	return 0, string(output)
+	return 0, stdout.String()
+}
+
+// signalGroup sends sig to the process group led by cmd.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
 }
 
 // && and || operators are handled separately in handleShellCmd
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"context"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRunCmdCancel(t *testing.T) {
+	previous := *config.GlobalSettings()
+	config.UpdateSettings(func(settings *config.Settings) { settings.CommandOutputLimit = 1024 })
+	defer config.InitSettings(previous)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	// The shell waits for a child of its own, which must be terminated too.
+	exitCode, result := runCmd(ctx, nil, []string{"sh", "-c", "echo partial; sleep 30 & wait"}, "", "", nil, 0)
+	assert.Less(t, time.Since(start), 5*time.Second, "Cancelling should terminate the process group.")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Equal(t, "partial\n", result, "The output so far should be returned.")
+
+	exitCode, result = runCmd(ctx, nil, []string{"echo", "late"}, "", "", nil, 0)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, result, "Nothing should run once cancelled.")
+}
+
+func TestRunCmdResult(t *testing.T) {
+	output, _ := newTestOutputStream(t)
+
+	// Shell operators are run by bash, with the arguments joined.
+	exitCode, result := runCmd(context.Background(), output, []string{"echo", "out;", "echo", "err", ">&2;", "exit", "3"}, "", "", nil, 0)
+	assert.Equal(t, 3, exitCode, "The exit code of the command should be kept.")
+	assert.Equal(t, "exit status 3", result)
+
+	var fin commandFin
+	output.finish(&fin)
+	assert.Equal(t, "out\n", fin.Stdout)
+	assert.Equal(t, "err\n", fin.Stderr)
+	assert.Empty(t, fin.Signal)
+
+	exitCode, _ = runCmd(context.Background(), output, []string{"sh", "-c", "kill -9 $$"}, "", "", nil, 0)
+	assert.Equal(t, -1, exitCode)
+	output.finish(&fin)
+	assert.Equal(t, "SIGKILL", fin.Signal)
+}
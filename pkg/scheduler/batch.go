@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"container/heap"
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// batchKeyNamespace is used to derive the idempotency key of a merged request.
+var batchKeyNamespace = uuid.MustParse("3f1d5bd2-6c0a-4f55-9a0e-2f5b3f4c7a61")
+
+// batchPolicies lists the endpoints that accept a JSON array of records in
+// a single request, with the maximum number of queued entries merged into one.
+var batchPolicies = []struct {
+	method string
+	prefix string
+	limit  int
+}{
+	{method: http.MethodPost, prefix: "/api/history/logs/", limit: 100},
+}
+
+// batchLimit returns how many entries, including entry itself, may be sent
+// together with entry. A limit of 1 means the entry is always sent alone.
+func batchLimit(entry *PriorityEntry) int {
+	if entry.alone {
+		return 1
+	}
+	for _, policy := range batchPolicies {
+		if entry.method == policy.method && strings.HasPrefix(entry.url, policy.prefix) {
+			return policy.limit
+		}
+	}
+	return 1
+}
+
+// takeBatch removes up to limit-1 due entries that can be sent together
+// with head, i.e. entries with the same method and URL that were not
+// split out of a rejected batch. Once a batch has been sent, its members
+// are only ever sent together again, so that a retry carries the same
+// records under the same idempotency key.
+func (rq *RequestQueue) takeBatch(head *PriorityEntry, limit int) []*PriorityEntry {
+	batch := []*PriorityEntry{head}
+
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	var matches []*PriorityEntry
+	for _, entry := range rq.ready {
+		if len(batch)+len(matches) >= limit {
+			break
+		}
+		if entry.method == head.method && entry.url == head.url && !entry.alone && entry.batch == head.batch {
+			matches = append(matches, entry)
+		}
+	}
+
+	// Removing shuffles the heap, so the matches are collected first.
+	for _, entry := range matches {
+		heap.Remove(&rq.ready, entry.index)
+		batch = append(batch, entry)
+	}
+
+	return batch
+}
+
+// mergeBatch builds a single JSON array out of the bodies of the entries.
+// Bodies that are arrays themselves are flattened into the result.
+func mergeBatch(entries []*PriorityEntry) (string, error) {
+	records := []json.RawMessage{}
+	for _, entry := range entries {
+		body := strings.TrimSpace(entry.data)
+		if strings.HasPrefix(body, "[") {
+			var items []json.RawMessage
+			if err := json.Unmarshal([]byte(body), &items); err != nil {
+				return "", err
+			}
+			records = append(records, items...)
+		} else {
+			records = append(records, json.RawMessage(body))
+		}
+	}
+
+	merged, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+
+	return string(merged), nil
+}
+
+// seal fixes the membership of a batch about to be sent for the first time,
+// recording its key on every member.
+func (rq *RequestQueue) seal(entries []*PriorityEntry) {
+	if entries[0].batch != "" {
+		return
+	}
+
+	key := batchKey(entries)
+	for _, entry := range entries {
+		entry.batch = key
+	}
+	rq.store.group(entries)
+}
+
+// idempotencyKey returns the key a request holding entry is sent with.
+func idempotencyKey(entry *PriorityEntry) string {
+	if entry.batch != "" {
+		return entry.batch
+	}
+	return entry.key
+}
+
+// batchKey derives an idempotency key from the keys of the merged entries.
+func batchKey(entries []*PriorityEntry) string {
+	if len(entries) == 1 {
+		return entries[0].key
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.key)
+	}
+	sort.Strings(keys)
+
+	return uuid.NewSHA1(batchKeyNamespace, []byte(strings.Join(keys, ","))).String()
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTakeBatchCollectsMatchingEntries(t *testing.T) {
+	rq := newTestQueue(10)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, rq.offer(&PriorityEntry{method: "POST", url: "/api/history/logs/", data: `{"msg":"x"}`, priority: 80, due: now}))
+	}
+	assert.NoError(t, rq.offer(&PriorityEntry{method: "POST", url: "/api/events/events/", priority: 90, due: now}))
+
+	head := rq.next()
+	assert.Equal(t, 100, batchLimit(head))
+
+	batch := rq.takeBatch(head, 2)
+	assert.Len(t, batch, 2, "Batch should be capped at the given limit.")
+	assert.Equal(t, 2, rq.size())
+
+	batch = rq.takeBatch(rq.next(), batchLimit(head))
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "/api/events/events/", rq.next().url)
+}
+
+func TestMergeBatchFlattensArrays(t *testing.T) {
+	merged, err := mergeBatch([]*PriorityEntry{
+		{data: `{"msg":"a"}`},
+		{data: `[{"msg":"b"},{"msg":"c"}]`},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"msg":"a"},{"msg":"b"},{"msg":"c"}]`, merged)
+
+	_, err = mergeBatch([]*PriorityEntry{{data: `{"msg":`}, {data: `{}`}})
+	assert.Error(t, err)
+}
+
+func TestBatchKeyIsStable(t *testing.T) {
+	a := &PriorityEntry{key: "a"}
+	b := &PriorityEntry{key: "b"}
+
+	assert.Equal(t, "a", batchKey([]*PriorityEntry{a}))
+	assert.Equal(t, batchKey([]*PriorityEntry{a, b}), batchKey([]*PriorityEntry{b, a}))
+	assert.NotEqual(t, batchKey([]*PriorityEntry{a, b}), batchKey([]*PriorityEntry{a, b, {key: "c"}}))
+}
+
+func TestRejectedBatchIsSplit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer server.Close()
+
+	queue := Rqueue
+	Rqueue = newTestQueue(10)
+	t.Cleanup(func() { Rqueue = queue })
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, Rqueue.offer(&PriorityEntry{method: "POST", url: "/api/history/logs/", data: `{"msg":"x"}`, priority: 90, due: now}))
+	}
+
+	reporter := &Reporter{session: newTestSession(server.URL, 0), counters: &counters{}}
+	head := Rqueue.next()
+	reporter.query(Rqueue.takeBatch(head, batchLimit(head)))
+
+	assert.Equal(t, 3, Rqueue.size(), "Members of a rejected batch should be requeued, not dropped.")
+	assert.Equal(t, 0, reporter.snapshot().Ignored)
+
+	head = Rqueue.next()
+	assert.Equal(t, 1, batchLimit(head))
+	assert.Len(t, Rqueue.takeBatch(head, 100), 1, "Split entries should not be batched again.")
+
+	reporter.query([]*PriorityEntry{head})
+	assert.Equal(t, 1, reporter.snapshot().Ignored, "An entry rejected on its own should be dropped.")
+}
+
+func TestRetriedBatchKeepsItsMembersAndKey(t *testing.T) {
+	type request struct {
+		key     string
+		records int
+	}
+	var mu sync.Mutex
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A lone record is sent as is, a batch as an array of records.
+		records := []json.RawMessage{nil}
+		var body json.RawMessage
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body[0] == '[' {
+			assert.NoError(t, json.Unmarshal(body, &records))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{key: r.Header.Get(idempotencyKeyHeader), records: len(records)})
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusRequestTimeout)
+		}
+	}))
+	defer server.Close()
+
+	queue := Rqueue
+	Rqueue = newTestQueue(10)
+	t.Cleanup(func() { Rqueue = queue })
+
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		require.NoError(t, Rqueue.offer(&PriorityEntry{key: key, method: "POST", url: "/api/history/logs/", data: `{"msg":"x"}`, priority: 90, due: now, retry: 5}))
+	}
+
+	reporter := &Reporter{session: newTestSession(server.URL, 0), counters: &counters{}}
+	head := Rqueue.next()
+	reporter.query(Rqueue.takeBatch(head, batchLimit(head)))
+	require.Len(t, requests, 1)
+	batch := requests[0].key
+
+	// A record queued meanwhile becomes due along with the failed batch.
+	Rqueue.mu.Lock()
+	require.Equal(t, 2, Rqueue.waiting.Len())
+	due := Rqueue.waiting[0].due
+	for _, entry := range Rqueue.waiting {
+		assert.Equal(t, batch, entry.batch)
+		assert.True(t, due.Equal(entry.due), "Members should be retried at the same time.")
+		entry.due = now
+	}
+	Rqueue.mu.Unlock()
+	require.NoError(t, Rqueue.offer(&PriorityEntry{key: "c", method: "POST", url: "/api/history/logs/", data: `{"msg":"x"}`, priority: 90, due: now, retry: 5}))
+
+	for Rqueue.size() > 0 {
+		head = Rqueue.next()
+		reporter.query(Rqueue.takeBatch(head, batchLimit(head)))
+	}
+
+	assert.ElementsMatch(t, []request{{key: batch, records: 2}, {key: "c", records: 1}}, requests[1:],
+		"The retry should resend the same records under the same key.")
+}
@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is the number of consecutive failures that opens the circuit.
+	breakerThreshold   = 5
+	minBreakerCooldown = 10 * time.Second
+	maxBreakerCooldown = 5 * time.Minute
+	// probeInterval is how long other reporters wait while a probe request
+	// checks whether a host has recovered.
+	probeInterval = 2 * time.Second
+)
+
+var (
+	breakers   = make(map[string]*circuitBreaker)
+	breakersMu sync.Mutex
+)
+
+// circuitBreaker is shared by all reporters sending to the same host, so that
+// they back off together instead of hammering an overloaded Alpacon server
+// in lockstep. Once the cooldown has elapsed, a single probe request is let
+// through; its outcome closes the circuit or opens it again for longer.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+func breakerFor(rawURL string) *circuitBreaker {
+	host := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	cb, ok := breakers[host]
+	if !ok {
+		cb = &circuitBreaker{}
+		breakers[host] = cb
+	}
+	return cb
+}
+
+// allow reports whether a request may be sent now. If not, it returns the
+// time at which the request should be attempted again.
+func (cb *circuitBreaker) allow(now time.Time) (time.Time, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return time.Time{}, true
+	}
+	if now.Before(cb.openUntil) {
+		return cb.openUntil, false
+	}
+	if cb.probing {
+		return now.Add(probeInterval), false
+	}
+
+	cb.probing = true
+	return time.Time{}, true
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.cooldown = 0
+	cb.openUntil = time.Time{}
+	cb.probing = false
+}
+
+// failure records a failed request. A Retry-After given by the server opens
+// the circuit right away for at least that long.
+func (cb *circuitBreaker) failure(now time.Time, retryAfter time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.failures < breakerThreshold && retryAfter <= 0 && !cb.probing {
+		return
+	}
+
+	if cb.cooldown == 0 {
+		cb.cooldown = minBreakerCooldown
+	} else {
+		cb.cooldown = min(cb.cooldown*2, maxBreakerCooldown)
+	}
+
+	cb.openUntil = now.Add(max(cb.cooldown, retryAfter))
+	cb.probing = false
+}
+
+// openCircuits returns the hosts whose circuit is currently open.
+func openCircuits(now time.Time) map[string]time.Time {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	circuits := make(map[string]time.Time)
+	for host, cb := range breakers {
+		cb.mu.Lock()
+		if now.Before(cb.openUntil) {
+			circuits[host] = cb.openUntil
+		}
+		cb.mu.Unlock()
+	}
+	return circuits
+}
@@ -0,0 +1,64 @@
+package scheduler
+
+// dueHeap orders entries that are not due yet by their due time, earliest first.
+type dueHeap []*PriorityEntry
+
+func (h dueHeap) Len() int { return len(h) }
+
+func (h dueHeap) Less(i, j int) bool {
+	return h[i].due.Before(h[j].due)
+}
+
+func (h dueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *dueHeap) Push(x any) {
+	entry := x.(*PriorityEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *dueHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// readyHeap orders entries that are due by priority (lower value first),
+// falling back to the due time for entries of the same priority.
+type readyHeap []*PriorityEntry
+
+func (h readyHeap) Len() int { return len(h) }
+
+func (h readyHeap) Less(i, j int) bool {
+	return lessFunc(h[i], h[j])
+}
+
+func (h readyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *readyHeap) Push(x any) {
+	entry := x.(*PriorityEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *readyHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyOptions holds the outbound proxy settings from the [proxy] section.
+// Without a URL, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables are honored instead.
+type ProxyOptions struct {
+	URL     string `json:"url,omitempty"` // including credentials, if any
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+// CurrentProxyOptions returns the proxy settings in use.
+func CurrentProxyOptions() ProxyOptions {
+	settings := config.GlobalSettings()
+	options := ProxyOptions{NoProxy: settings.NoProxy}
+
+	if settings.ProxyURL != "" {
+		proxyURL, err := url.Parse(settings.ProxyURL)
+		if err == nil {
+			if settings.ProxyUsername != "" {
+				proxyURL.User = url.UserPassword(settings.ProxyUsername, settings.ProxyPassword)
+			}
+			options.URL = proxyURL.String()
+		}
+	}
+
+	return options
+}
+
+// ProxyFunc returns the proxy selection function used by HTTP transports
+// and websocket dialers. Websocket dialers tunnel through the proxy with CONNECT.
+func (options ProxyOptions) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	var proxyURL *url.URL
+	if options.URL != "" {
+		proxyURL, _ = url.Parse(options.URL)
+	}
+	noProxy := parseNoProxy(options.NoProxy)
+
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxy.match(req.URL) {
+			return nil, nil
+		}
+		if proxyURL == nil {
+			return http.ProxyFromEnvironment(req)
+		}
+		return proxyURL, nil
+	}
+}
+
+type noProxyList []string
+
+// parseNoProxy parses a comma-separated list of hosts, domains (matching
+// their subdomains too), IP addresses and CIDR ranges, each optionally
+// with a port. "*" disables the proxy for every host.
+func parseNoProxy(value string) noProxyList {
+	var list noProxyList
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func (list noProxyList) match(target *url.URL) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+
+	for _, entry := range list {
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip := net.ParseIP(host); ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		if strings.HasPrefix(entryHost, ".") {
+			if strings.HasSuffix(host, entryHost) || host == entryHost[1:] {
+				return true
+			}
+		} else if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNoProxyMatches(t *testing.T) {
+	list := parseNoProxy("localhost, .internal.example.com,alpacon.io:8443, 10.0.0.0/8")
+
+	for target, expected := range map[string]bool{
+		"http://localhost/":                true,
+		"https://a.internal.example.com/":  true,
+		"https://internal.example.com/":    true,
+		"https://alpacon.io:8443/":         true,
+		"https://alpacon.io/":              false,
+		"https://sub.alpacon.io:8443/":     true,
+		"http://10.1.2.3/":                 true,
+		"http://192.168.0.1/":              false,
+		"https://notinternal.example.com/": false,
+	} {
+		parsed, err := url.Parse(target)
+		require.NoError(t, err)
+		assert.Equal(t, expected, list.match(parsed), target)
+	}
+
+	parsed, _ := url.Parse("https://anything/")
+	assert.True(t, parseNoProxy("*").match(parsed))
+}
+
+// newProxyStandIn starts a minimal forward proxy that checks the proxy
+// credentials, forwards plain HTTP requests and tunnels CONNECT requests.
+func newProxyStandIn(requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, client)
+			_ = upstream.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(client, upstream)
+			_ = client.Close()
+		}()
+	}))
+}
+
+func TestRequestsGoThroughProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := newProxyStandIn(&proxied)
+	defer proxy.Close()
+
+	upgrader := websocket.Upgrader{}
+	alpacon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws/" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+				_ = conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer alpacon.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("alpamon", "secret")
+	options := ProxyOptions{URL: proxyURL.String()}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = options.ProxyFunc()
+	resp, err := (&http.Client{Transport: transport}).Get(alpacon.URL + "/api/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, int32(1), proxied.Load())
+
+	conn, _, err := newDialer(nil, options).Dial(strings.Replace(alpacon.URL, "http", "ws", 1)+"/ws/", nil)
+	require.NoError(t, err)
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, "hello", string(message))
+	assert.Equal(t, int32(2), proxied.Load(), "Websocket should be tunnelled with CONNECT.")
+
+	options.NoProxy = "127.0.0.1"
+	transport.Proxy = options.ProxyFunc()
+	resp, err = (&http.Client{Transport: transport}).Get(alpacon.URL + "/api/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, int32(2), proxied.Load(), "Hosts in no_proxy should be reached directly.")
+}
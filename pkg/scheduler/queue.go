@@ -1,9 +1,15 @@
 package scheduler
 
 import (
-	"github.com/adrianbrad/queue"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,67 +19,511 @@ var (
 )
 
 const (
-	RetryLimit   = 5
-	MaxQueueSize = 10 * 60 * 60 // 10 entries/second * 1h
+	overflowEventURL = "/api/events/events/"
 )
 
+var (
+	errQueueFull  = errors.New("queue is full")
+	errSuperseded = errors.New("superseded by a newer request")
+	errClosed     = errors.New("queue is closed")
+)
+
+// ttlPolicies defines how long entries stay relevant, by URL prefix. The
+// first matching prefix wins; entries matching none of them never expire.
+// Command acks and fins must never be dropped, so they are listed explicitly.
+var ttlPolicies = []struct {
+	prefix string
+	ttl    time.Duration
+}{
+	{prefix: "/api/events/commands/", ttl: 0},
+	{prefix: "/api/servers/servers/-/sync/", ttl: 10 * time.Minute}, // version and load average
+	{prefix: "/api/history/logs/", ttl: 1 * time.Hour},
+}
+
+// ttlFor returns the time-to-live of entries sent to url, 0 meaning no expiry.
+func ttlFor(url string) time.Duration {
+	for _, policy := range ttlPolicies {
+		if strings.HasPrefix(url, policy.prefix) {
+			return policy.ttl
+		}
+	}
+	return 0
+}
+
 func newRequestQueue() {
+	store, err := openQueueStore()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open the queue journal, queued requests will not survive a restart.")
+		store = nil
+	}
+
 	Rqueue = &RequestQueue{
-		queue: queue.NewPriority(
-			[]PriorityEntry{},
-			lessFunc,
-			queue.WithCapacity(MaxQueueSize),
-		),
-		cond: sync.NewCond(&sync.Mutex{}),
+		capacity: config.GlobalSettings().MaxQueueSize,
+		store:    store,
+	}
+	Rqueue.cond = sync.NewCond(&Rqueue.mu)
+
+	Rqueue.replay()
+}
+
+// replay re-offers the entries journaled by a previous run of alpamon.
+func (rq *RequestQueue) replay() {
+	entries, err := rq.store.load()
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to load queued requests from %s.", rq.store.path)
+		return
+	}
+
+	replayed := 0
+	now := time.Now()
+	for _, entry := range entries {
+		// Entries that expired while alpamon was not running are not worth sending.
+		if !entry.expiry.IsZero() && entry.expiry.Before(now) {
+			log.Debug().Msgf("Dropping expired replayed entry: %s %s", entry.method, entry.url)
+			rq.store.remove(entry)
+			continue
+		}
+		// Entries are loaded oldest first, so a later write to the same URL wins.
+		if rq.coalesce(entry) {
+			rq.store.remove(entry)
+			continue
+		}
+		err = rq.offer(entry)
+		if err != nil {
+			log.Error().Err(err).Msgf("Queue is full, dropping replayed entry: %s", entry.url)
+			rq.store.remove(entry)
+			continue
+		}
+		replayed++
+	}
+
+	if replayed > 0 {
+		log.Info().Msgf("Replayed %d queued requests from %s.", replayed, rq.store.path)
 	}
 }
 
-// less function of PriorityQueue
-func lessFunc(elem, otherElem PriorityEntry) bool {
+// less function of the ready heap
+func lessFunc(elem, otherElem *PriorityEntry) bool {
 	if elem.priority == otherElem.priority {
 		return elem.due.Before(otherElem.due) // elem.Due < otherElem.Due
 	}
 	return elem.priority < otherElem.priority
 }
 
-func (rq *RequestQueue) request(method, url string, data interface{}, priority int, due time.Time) {
+func (rq *RequestQueue) request(method, url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
 	// time.Time{} : 0001-01-01 00:00:00 +0000 UTC
 	if due.IsZero() {
 		due = time.Now()
 	}
 
-	entry := PriorityEntry{
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = due.Add(ttl)
+	}
+
+	body, err := encodeData(data)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to encode request body, dropping entry: %s", url)
+		return
+	}
+
+	entry := &PriorityEntry{
+		key:      uuid.NewString(),
 		priority: priority,
 		method:   method,
 		url:      url,
-		data:     data,
+		data:     body,
 		due:      due,
-		// expiry:
-		retry: RetryLimit,
+		expiry:   expiry,
+		retry:    config.GlobalSettings().RetryLimit,
+	}
+
+	if rq.coalesce(entry) {
+		return
 	}
 
-	// Do not wake reporter goroutine if the queue is full or uninitialized.
-	err := rq.queue.Offer(entry)
+	// Journal the entry before it becomes visible to reporters,
+	// so that it can be removed once it has been delivered.
+	err = rq.store.insert(entry)
 	if err != nil {
-		log.Error().Err(err).Msgf("Queue is full or uninitialized, dropping entry: %s", entry.url)
+		log.Warn().Err(err).Msgf("Failed to journal entry, it will not survive a restart: %s", entry.url)
+	}
+
+	err = rq.offer(entry)
+	if errors.Is(err, errClosed) {
+		log.Debug().Msgf("Queue is closed, entry is left for the next run: %s", entry.url)
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Dropping entry: %s", entry.url)
+		rq.store.remove(entry)
+	}
+}
+
+// offer schedules an entry. Entries that are already due are handed to a
+// waiting reporter right away; the others wait in the due heap until the
+// queue timer fires for them. If the queue is full, the least important
+// entry is evicted to make room, unless that would be the new entry itself.
+func (rq *RequestQueue) offer(entry *PriorityEntry) error {
+	evicted, err := rq.push(entry)
+	if evicted != nil {
+		log.Debug().Msgf("Queue is full, evicted entry: %s %s (priority %d)", evicted.method, evicted.url, evicted.priority)
+		rq.store.remove(evicted)
+	}
+
+	return err
+}
+
+func (rq *RequestQueue) push(entry *PriorityEntry) (evicted *PriorityEntry, err error) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	if rq.closed {
+		return nil, errClosed
+	}
+
+	// A retried entry must not overwrite a newer write to the same URL.
+	if key := coalesceKey(entry); key != "" && rq.pending[key] != nil {
+		rq.coalescedTotal++
+		return nil, errSuperseded
+	}
+
+	if rq.ready.Len()+rq.waiting.Len() >= rq.capacity {
+		evicted = rq.evict(entry)
+		if evicted == nil {
+			return nil, errQueueFull
+		}
+		rq.evicted++
+		rq.evictedTotal++
+	}
+
+	rq.schedule(entry)
+
+	return evicted, nil
+}
+
+// setCapacity changes the maximum number of queued entries. Entries over a
+// lowered capacity are evicted as new ones come in.
+func (rq *RequestQueue) setCapacity(capacity int) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	rq.capacity = capacity
+}
+
+// schedule puts an entry in the heap matching its due time. It must be
+// called with rq.mu held.
+func (rq *RequestQueue) schedule(entry *PriorityEntry) {
+	if key := coalesceKey(entry); key != "" {
+		if rq.pending == nil {
+			rq.pending = make(map[string]*PriorityEntry)
+		}
+		rq.pending[key] = entry
+	}
+
+	if entry.due.After(time.Now()) {
+		heap.Push(&rq.waiting, entry)
+		rq.armTimer()
+	} else {
+		heap.Push(&rq.ready, entry)
+		rq.cond.Signal()
+	}
+}
+
+// unschedule removes a queued entry from the heap holding it. It must be
+// called with rq.mu held.
+func (rq *RequestQueue) unschedule(entry *PriorityEntry) {
+	switch {
+	case entry.index < 0:
+		// already popped by a reporter
+	case entry.index < rq.ready.Len() && rq.ready[entry.index] == entry:
+		heap.Remove(&rq.ready, entry.index)
+	case entry.index < rq.waiting.Len() && rq.waiting[entry.index] == entry:
+		heap.Remove(&rq.waiting, entry.index)
+	}
+	rq.forget(entry)
+}
+
+// forget drops an entry that left the heaps from the coalescing index.
+// It must be called with rq.mu held.
+func (rq *RequestQueue) forget(entry *PriorityEntry) {
+	if key := coalesceKey(entry); key != "" && rq.pending[key] == entry {
+		delete(rq.pending, key)
+	}
+}
+
+// coalesceKey returns the key under which writes replacing each other are
+// coalesced, or an empty string if the entry must be sent as is. PATCH
+// bodies built by alpamon always carry the whole object, so the latest
+// write to a URL makes the previous ones obsolete.
+func coalesceKey(entry *PriorityEntry) string {
+	switch entry.method {
+	case http.MethodPatch, http.MethodPut, http.MethodDelete:
+		return entry.method + " " + entry.url
+	default:
+		return ""
+	}
+}
+
+// coalesce merges entry into a queued write to the same URL that has not
+// been picked up by a reporter yet. It returns false if there is none.
+func (rq *RequestQueue) coalesce(entry *PriorityEntry) bool {
+	key := coalesceKey(entry)
+	if key == "" {
+		return false
+	}
+
+	rq.mu.Lock()
+	queued := rq.pending[key]
+	if queued == nil {
+		rq.mu.Unlock()
+		return false
+	}
+
+	rq.unschedule(queued)
+	// The queued entry may have reached the server in an attempt that timed
+	// out, so the new data must not be deduplicated against it.
+	queued.key = entry.key
+	queued.data = entry.data
+	queued.expiry = entry.expiry
+	queued.retry = entry.retry
+	if entry.priority < queued.priority {
+		queued.priority = entry.priority
+	}
+	if entry.due.Before(queued.due) {
+		queued.due = entry.due
+	}
+	rq.schedule(queued)
+	rq.coalescedTotal++
+	rq.mu.Unlock()
+
+	// The reporter may deliver and remove the row before this update lands,
+	// in which case it has already sent the new data and nothing is lost.
+	rq.store.replace(queued)
+
+	return true
+}
+
+// evict removes the queued entry with the lowest priority, the oldest one
+// among equals, if it is not more important than entry. It must be called
+// with rq.mu held.
+func (rq *RequestQueue) evict(entry *PriorityEntry) *PriorityEntry {
+	var victim *PriorityEntry
+	var fromReady bool
+
+	worse := func(candidate *PriorityEntry) bool {
+		if victim == nil || candidate.priority > victim.priority {
+			return true
+		}
+		return candidate.priority == victim.priority && candidate.due.Before(victim.due)
+	}
+
+	for _, candidate := range rq.ready {
+		if worse(candidate) {
+			victim, fromReady = candidate, true
+		}
+	}
+	for _, candidate := range rq.waiting {
+		if worse(candidate) {
+			victim, fromReady = candidate, false
+		}
+	}
+
+	if victim == nil || victim.priority < entry.priority {
+		return nil
+	}
+
+	if fromReady {
+		heap.Remove(&rq.ready, victim.index)
+	} else {
+		heap.Remove(&rq.waiting, victim.index)
+	}
+	rq.forget(victim)
+
+	return victim
+}
+
+// reportEvictions posts a warning event to Alpacon if entries have been
+// evicted since the last report. Reporters call it once delivery succeeds
+// again, as the event could not have been delivered while Alpacon was unreachable.
+func (rq *RequestQueue) reportEvictions() {
+	rq.mu.Lock()
+	evicted, capacity := rq.evicted, rq.capacity
+	rq.evicted = 0
+	rq.mu.Unlock()
+
+	if evicted == 0 {
 		return
 	}
 
+	log.Warn().Msgf("Request queue was full, %d entries were evicted.", evicted)
+	rq.Post(overflowEventURL, map[string]string{
+		"reporter":    "alpamon",
+		"record":      "queue overflow",
+		"description": fmt.Sprintf("Request queue reached its capacity of %d entries, %d entries with lower priority were discarded.", capacity, evicted),
+	}, 20, time.Time{})
+}
+
+// next blocks until an entry is due and returns the one with the highest
+// priority among the due entries. It returns nil once the queue is closed.
+// Reporters must call done when they are finished with the entry.
+func (rq *RequestQueue) next() *PriorityEntry {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	for {
+		if rq.closed {
+			return nil
+		}
+
+		now := time.Now()
+		for rq.waiting.Len() > 0 && !rq.waiting[0].due.After(now) {
+			heap.Push(&rq.ready, heap.Pop(&rq.waiting))
+		}
+		rq.armTimer()
+
+		if rq.ready.Len() > 0 {
+			entry := heap.Pop(&rq.ready).(*PriorityEntry)
+			rq.forget(entry)
+			// Hand the remaining due entries to another reporter.
+			if rq.ready.Len() > 0 {
+				rq.cond.Signal()
+			}
+			rq.inflight++
+			return entry
+		}
+
+		rq.cond.Wait()
+	}
+}
+
+// armTimer makes sure the queue timer fires no later than the due time of
+// the earliest waiting entry. It must be called with rq.mu held.
+func (rq *RequestQueue) armTimer() {
+	if rq.waiting.Len() == 0 {
+		return
+	}
+
+	due := rq.waiting[0].due
+	if !rq.timerAt.IsZero() && !due.Before(rq.timerAt) {
+		return
+	}
+
+	rq.timerAt = due
+	if rq.timer == nil {
+		rq.timer = time.AfterFunc(time.Until(due), rq.wake)
+	} else {
+		rq.timer.Reset(time.Until(due))
+	}
+}
+
+func (rq *RequestQueue) wake() {
+	rq.mu.Lock()
+	rq.timerAt = time.Time{}
+	rq.mu.Unlock()
+
 	rq.cond.Signal()
 }
 
+func (rq *RequestQueue) done() {
+	rq.mu.Lock()
+	rq.inflight--
+	rq.mu.Unlock()
+}
+
+// drained reports whether every due entry has been handled. Entries
+// waiting for a later retry are not considered.
+func (rq *RequestQueue) drained() bool {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	due := rq.waiting.Len() > 0 && !rq.waiting[0].due.After(time.Now())
+	return rq.ready.Len() == 0 && rq.inflight == 0 && !due
+}
+
+// close stops the queue: reporters blocked in next return, and entries
+// offered from now on are only left in the journal.
+func (rq *RequestQueue) close() {
+	rq.mu.Lock()
+	rq.closed = true
+	if rq.timer != nil {
+		rq.timer.Stop()
+	}
+	rq.mu.Unlock()
+
+	rq.cond.Broadcast()
+}
+
+func (rq *RequestQueue) evictions() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	return rq.evictedTotal
+}
+
+func (rq *RequestQueue) coalesced() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	return rq.coalescedTotal
+}
+
+func (rq *RequestQueue) size() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	return rq.ready.Len() + rq.waiting.Len()
+}
+
+// oldestDue returns the earliest due time among the queued entries.
+func (rq *RequestQueue) oldestDue() time.Time {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	var oldest time.Time
+	if rq.waiting.Len() > 0 {
+		oldest = rq.waiting[0].due
+	}
+	for _, entry := range rq.ready {
+		if oldest.IsZero() || entry.due.Before(oldest) {
+			oldest = entry.due
+		}
+	}
+
+	return oldest
+}
+
+// encodeData converts a request body into the raw payload sent to Alpacon,
+// which is also the form stored in the queue journal.
+func encodeData(data interface{}) (string, error) {
+	switch v := data.(type) {
+	case nil:
+		return "", nil
+	case []byte:
+		return string(v), nil
+	case string:
+		return v, nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// Post, Patch, Put and Delete queue a request to Alpacon. The entry expires
+// according to ttlPolicies and is dropped if it cannot be delivered in time.
 func (rq *RequestQueue) Post(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPost, url, data, priority, due)
+	rq.request(http.MethodPost, url, data, priority, due, ttlFor(url))
 }
 
 func (rq *RequestQueue) Patch(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPatch, url, data, priority, due)
+	rq.request(http.MethodPatch, url, data, priority, due, ttlFor(url))
 }
 
 func (rq *RequestQueue) Put(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPut, url, data, priority, due)
+	rq.request(http.MethodPut, url, data, priority, due, ttlFor(url))
 }
 
 func (rq *RequestQueue) Delete(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodDelete, url, data, priority, due)
+	rq.request(http.MethodDelete, url, data, priority, due, ttlFor(url))
 }
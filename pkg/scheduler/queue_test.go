@@ -0,0 +1,217 @@
+package scheduler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(capacity int) *RequestQueue {
+	rq := &RequestQueue{capacity: capacity}
+	rq.cond = sync.NewCond(&rq.mu)
+	return rq
+}
+
+func TestNextRespectsPriorityAmongDueEntries(t *testing.T) {
+	rq := newTestQueue(10)
+	now := time.Now()
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/logs/", priority: 90, due: now.Add(-2 * time.Second)}))
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/fin/", priority: 10, due: now}))
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/commit/", priority: 80, due: now.Add(-time.Second)}))
+
+	assert.Equal(t, "/fin/", rq.next().url)
+	assert.Equal(t, "/commit/", rq.next().url)
+	assert.Equal(t, "/logs/", rq.next().url)
+}
+
+func TestNextBlocksUntilEntryIsDue(t *testing.T) {
+	rq := newTestQueue(10)
+	due := time.Now().Add(100 * time.Millisecond)
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/later/", priority: 10, due: due}))
+
+	entry := rq.next()
+	assert.Equal(t, "/later/", entry.url)
+	assert.False(t, time.Now().Before(due), "Entry should not be returned before it is due.")
+}
+
+func TestEarlierEntryRearmsTimer(t *testing.T) {
+	rq := newTestQueue(10)
+	now := time.Now()
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/late/", priority: 10, due: now.Add(time.Hour)}))
+
+	done := make(chan *PriorityEntry)
+	go func() { done <- rq.next() }()
+
+	// Give the reporter time to block on the hour-long entry.
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/soon/", priority: 90, due: now.Add(50 * time.Millisecond)}))
+
+	select {
+	case entry := <-done:
+		assert.Equal(t, "/soon/", entry.url)
+	case <-time.After(time.Second):
+		t.Fatal("Reporter was not woken up for the earlier entry.")
+	}
+}
+
+func TestOfferRejectsLessImportantEntryWhenFull(t *testing.T) {
+	rq := newTestQueue(1)
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/fin/", priority: 10, due: time.Now()}))
+	assert.ErrorIs(t, rq.offer(&PriorityEntry{url: "/logs/", priority: 90, due: time.Now()}), errQueueFull)
+	assert.Equal(t, 1, rq.size())
+	assert.Equal(t, 0, rq.evictions())
+}
+
+func TestOfferEvictsLowestPriorityOldestEntry(t *testing.T) {
+	rq := newTestQueue(3)
+	now := time.Now()
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/logs/old/", priority: 90, due: now.Add(-time.Minute)}))
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/logs/new/", priority: 90, due: now.Add(-time.Second)}))
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/commit/", priority: 80, due: now}))
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/fin/", priority: 10, due: now}))
+	assert.Equal(t, 3, rq.size())
+	assert.Equal(t, 1, rq.evictions())
+
+	assert.Equal(t, "/fin/", rq.next().url)
+	assert.Equal(t, "/commit/", rq.next().url)
+	assert.Equal(t, "/logs/new/", rq.next().url)
+}
+
+func TestCoalesceLatestPatchWins(t *testing.T) {
+	rq := newTestQueue(10)
+	now := time.Now()
+
+	first := &PriorityEntry{method: "PATCH", url: "/api/proc/users/1/", data: `{"shell":"/bin/sh"}`, priority: 80, due: now}
+	assert.False(t, rq.coalesce(first))
+	assert.NoError(t, rq.offer(first))
+
+	second := &PriorityEntry{method: "PATCH", url: "/api/proc/users/1/", data: `{"shell":"/bin/bash"}`, priority: 80, due: now}
+	assert.True(t, rq.coalesce(second))
+	assert.Equal(t, 1, rq.size())
+
+	entry := rq.next()
+	assert.Equal(t, `{"shell":"/bin/bash"}`, entry.data)
+	assert.False(t, rq.coalesce(&PriorityEntry{method: "PATCH", url: "/api/proc/users/1/", due: now}),
+		"Entries picked up by a reporter must not be coalesced.")
+}
+
+func TestRetriedEntryIsSuperseded(t *testing.T) {
+	rq := newTestQueue(10)
+	now := time.Now()
+
+	assert.NoError(t, rq.offer(&PriorityEntry{method: "PUT", url: "/commit/", data: "new", due: now}))
+	assert.ErrorIs(t, rq.offer(&PriorityEntry{method: "PUT", url: "/commit/", data: "old", due: now}), errSuperseded)
+	assert.Equal(t, "new", rq.next().data)
+}
+
+func TestCloseReleasesReporters(t *testing.T) {
+	rq := newTestQueue(10)
+
+	assert.NoError(t, rq.offer(&PriorityEntry{url: "/fin/", priority: 10, due: time.Now()}))
+	entry := rq.next()
+	assert.False(t, rq.drained(), "Entries handed to a reporter are not drained until done.")
+	rq.done()
+	assert.True(t, rq.drained())
+
+	done := make(chan *PriorityEntry)
+	go func() { done <- rq.next() }()
+	rq.close()
+
+	select {
+	case entry = <-done:
+		assert.Nil(t, entry)
+	case <-time.After(time.Second):
+		t.Fatal("Reporter was not released when the queue was closed.")
+	}
+	assert.ErrorIs(t, rq.offer(&PriorityEntry{url: "/logs/", priority: 90, due: time.Now()}), errClosed)
+}
+
+func TestTTLFor(t *testing.T) {
+	for url, ttl := range map[string]time.Duration{
+		"/api/events/commands/1/ack/":   0,
+		"/api/events/commands/1/fin/":   0,
+		"/api/servers/servers/-/sync/":  10 * time.Minute,
+		"/api/history/logs/":            time.Hour,
+		"/api/servers/servers/-/commit": 0,
+	} {
+		assert.Equal(t, ttl, ttlFor(url), url)
+	}
+}
+
+func TestPostSetsExpiry(t *testing.T) {
+	rq := newTestQueue(10)
+	due := time.Now()
+	rq.Post("/api/events/commands/1/fin/", map[string]bool{"success": true}, 10, due)
+	rq.Post("/api/servers/servers/-/sync/", map[string]string{"version": "1.0"}, 80, due)
+
+	fin := rq.next()
+	assert.True(t, fin.expiry.IsZero(), "Commands should never expire.")
+	synced := rq.next()
+	assert.True(t, due.Add(10*time.Minute).Equal(synced.expiry), "Sync data should expire after 10 minutes.")
+}
+
+func TestRunDropsExpiredEntries(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.URL.Path)
+	}))
+	defer server.Close()
+
+	queue := Rqueue
+	Rqueue = newTestQueue(10)
+	t.Cleanup(func() { Rqueue = queue })
+
+	now := time.Now()
+	require.NoError(t, Rqueue.offer(&PriorityEntry{method: "POST", url: "/api/history/logs/", data: `{}`, priority: 90, due: now, expiry: now.Add(-time.Second)}))
+	require.NoError(t, Rqueue.offer(&PriorityEntry{method: "POST", url: "/api/events/commands/1/fin/", data: `{}`, priority: 10, due: now}))
+
+	reporter := &Reporter{session: newTestSession(server.URL, 0), counters: &counters{}}
+	done := make(chan struct{})
+	go func() {
+		reporter.Run()
+		close(done)
+	}()
+	assert.Eventually(t, Rqueue.drained, time.Second, 10*time.Millisecond)
+	Rqueue.close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/api/events/commands/1/fin/"}, received, "An expired entry should be discarded, not sent.")
+	assert.Equal(t, 1, reporter.snapshot().Expired)
+}
+
+func TestReplayDropsExpiredEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queueDBFileName)
+	store := openTestStore(t, path)
+	now := time.Now()
+	require.NoError(t, store.insert(&PriorityEntry{key: "a", priority: 80, method: "POST", url: "/api/servers/servers/-/sync/", data: `{}`, due: now, expiry: now.Add(-time.Minute), retry: 5}))
+	require.NoError(t, store.insert(&PriorityEntry{key: "b", priority: 10, method: "POST", url: "/api/events/commands/1/fin/", data: `{}`, due: now, retry: 5}))
+	store.close()
+
+	rq := newTestQueue(10)
+	rq.store = openTestStore(t, path)
+	defer rq.store.close()
+
+	rq.replay()
+	assert.Equal(t, 1, rq.size(), "Entries that expired while alpamon was down should not be replayed.")
+	entries, err := rq.store.load()
+	require.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "b", entries[0].key)
+	}
+}
@@ -0,0 +1,34 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+)
+
+// ApplySettings brings the session and the request queue in line with
+// config.GlobalSettings() after the config was reloaded. New connections use
+// the new server URL, credentials, TLS and proxy settings; established
+// websockets keep theirs until they reconnect. Nothing is changed if the
+// TLS material cannot be loaded.
+func ApplySettings(session *Session) error {
+	settings := config.GlobalSettings()
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to set up TLS: %w", err)
+	}
+	clientTLSConfig.Store(tlsConfig)
+
+	if session.transport != nil {
+		previous := session.transport.current.Swap(NewTransport())
+		previous.CloseIdleConnections()
+	}
+	session.SetBaseURL(settings.ServerURL)
+	session.SetCredentials(settings.ID, settings.Key)
+	session.gzipMinSize.Store(int64(settings.GzipMinSize))
+
+	if Rqueue != nil {
+		Rqueue.setCapacity(settings.MaxQueueSize)
+	}
+
+	return nil
+}
@@ -6,15 +6,35 @@ import (
 	"github.com/alpacanetworks/alpamon-go/pkg/config"
 	"github.com/alpacanetworks/alpamon-go/pkg/utils"
 	"github.com/alpacanetworks/alpamon-go/pkg/version"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	startUpEventURL = "/api/events/events/"
+
+	drainInterval = 100 * time.Millisecond
+
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// maxURLFailures bounds the number of endpoints failures are counted
+	// for. Failures of any other endpoint are counted under otherEndpoint.
+	maxURLFailures = 100
+	otherEndpoint  = "other"
+)
+
+var (
+	reporters   []*Reporter
+	reportersMu sync.RWMutex
+	reportersWg sync.WaitGroup
+
+	urlFailures   = make(map[string]int) // by endpointPattern
+	urlFailuresMu sync.Mutex
 )
 
 func NewReporter(index int, session *Session) *Reporter {
@@ -25,6 +45,7 @@ func NewReporter(index int, session *Session) *Reporter {
 			success: 0,
 			failure: 0,
 			ignored: 0,
+			expired: 0,
 			delay:   0.0,
 			latency: 0.0,
 		},
@@ -34,12 +55,14 @@ func NewReporter(index int, session *Session) *Reporter {
 func StartReporters(session *Session) {
 	newRequestQueue() // init RequestQueue
 
-	wg := sync.WaitGroup{}
-	for i := 0; i < config.GlobalSettings.HTTPThreads; i++ {
-		wg.Add(1)
+	for i := 0; i < config.GlobalSettings().HTTPThreads; i++ {
+		reportersWg.Add(1)
 		reporter := NewReporter(i, session)
+		reportersMu.Lock()
+		reporters = append(reporters, reporter)
+		reportersMu.Unlock()
 		go func() {
-			defer wg.Done()
+			defer reportersWg.Done()
 			reporter.Run()
 		}()
 	}
@@ -47,6 +70,31 @@ func StartReporters(session *Session) {
 	reportStartupEvent()
 }
 
+// StopReporters sends the entries that are due, waiting at most timeout
+// for them to be delivered, then stops the reporters and closes the queue
+// journal. Entries that could not be sent in time stay in the journal and
+// are replayed on the next start.
+func StopReporters(timeout time.Duration) {
+	if Rqueue == nil {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !Rqueue.drained() && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+	if !Rqueue.drained() {
+		log.Warn().Msgf("Request queue was not drained within %s, %d entries are left for the next run.", timeout, Rqueue.size())
+	}
+
+	Rqueue.close()
+	if !utils.WaitTimeout(&reportersWg, time.Until(deadline)) {
+		log.Warn().Msg("Reporters did not stop in time.")
+		return
+	}
+	Rqueue.store.close()
+}
+
 func reportStartupEvent() {
 	eventData, _ := json.Marshal(map[string]string{
 		"reporter":    "alpamon",
@@ -57,72 +105,285 @@ func reportStartupEvent() {
 	Rqueue.Post(startUpEventURL, eventData, 10, time.Time{})
 }
 
-func (r *Reporter) query(entry PriorityEntry) {
+// query sends a batch of entries as a single request. Batches hold a
+// single entry unless the endpoint accepts merged records (see batchPolicies).
+func (r *Reporter) query(entries []*PriorityEntry) {
+	entry := entries[0]
+	data := entry.data
+	if len(entries) > 1 {
+		merged, err := mergeBatch(entries)
+		if err != nil {
+			log.Debug().Err(err).Msgf("Failed to merge %d entries for %s, sending them one by one.", len(entries), entry.url)
+			for _, other := range entries[1:] {
+				r.requeue(other)
+			}
+			entries = entries[:1]
+		} else {
+			data = merged
+			Rqueue.seal(entries)
+		}
+	}
+
+	var body interface{}
+	if data != "" {
+		body = data
+	}
+
+	req, err := r.session.newRequest(entry.method, entry.url, body)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to build request, dropping entry: %s %s", entry.method, entry.url)
+		for _, dropped := range entries {
+			r.count(&r.counters.ignored)
+			Rqueue.store.remove(dropped)
+		}
+		return
+	}
+
+	// Lets the server deduplicate a POST that reached it in an attempt that
+	// timed out on our side and is now being retried.
+	if entry.method == http.MethodPost {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey(entry))
+	}
+
+	breaker := breakerFor(req.URL.String())
+	if retryAt, ok := breaker.allow(time.Now()); !ok {
+		due := retryAt.Add(retryDelay(0) / 2)
+		for _, deferred := range entries {
+			r.postpone(deferred, due)
+		}
+		return
+	}
+
 	t1 := time.Now()
-	resp, statusCode, err := r.session.Request(entry.method, entry.url, entry.data, 5)
+	resp, statusCode, header, err := r.session.send(req, requestTimeout())
 	t2 := time.Now()
 
+	r.counters.mu.Lock()
 	r.counters.delay = r.counters.delay*0.9 + (t2.Sub(entry.due).Seconds())*0.1
 	r.counters.latency = r.counters.latency*0.9 + (t2.Sub(t1).Seconds())*0.1
+	r.counters.mu.Unlock()
 
-	var success bool
+	var retryAfter time.Duration
 	if err != nil {
 		log.Error().Err(err).Msgf("%s %s", entry.method, entry.url)
-		success = false
+		breaker.failure(t2, 0)
 	} else if utils.IsSuccessStatusCode(statusCode) {
-		success = true
-	} else {
+		breaker.success()
+		for _, delivered := range entries {
+			r.count(&r.counters.success)
+			Rqueue.store.remove(delivered)
+		}
+		Rqueue.reportEvictions()
+		return
+	} else if isPermanentFailure(statusCode) {
+		// The server is reachable and answering, so the circuit stays closed.
+		breaker.success()
+		if len(entries) > 1 {
+			// A single bad record, or the size of the batch itself, gets the
+			// whole batch rejected, so its members are tried on their own.
+			log.Warn().Msgf("%s %s rejected a batch of %d entries with %d, sending them one by one.",
+				entry.method, entry.url, len(entries), statusCode)
+			for _, member := range entries {
+				member.alone = true
+				member.batch = ""
+				Rqueue.store.update(member)
+				r.requeue(member)
+			}
+			return
+		}
 		if statusCode == http.StatusBadRequest {
 			log.Error().Err(err).Msgf("%d Bad Request: %s", statusCode, resp)
 		} else {
-			log.Debug().Msgf("%s %s Error: %d %s", entry.method, entry.url, statusCode, resp)
+			log.Error().Msgf("%s %s rejected with %d, dropping entry: %s", entry.method, entry.url, statusCode, resp)
+		}
+		countURLFailure(entry.url)
+		for _, rejected := range entries {
+			r.count(&r.counters.failure)
+			r.count(&r.counters.ignored)
+			Rqueue.store.remove(rejected)
+		}
+		return
+	} else {
+		log.Debug().Msgf("%s %s Error: %d %s", entry.method, entry.url, statusCode, resp)
+		if isOverloaded(statusCode) {
+			retryAfter = parseRetryAfter(header.Get("Retry-After"), t2)
+			breaker.failure(t2, retryAfter)
+		} else {
+			breaker.success()
 		}
-		success = false
 	}
 
-	if success {
-		r.counters.success++
+	// Members of a batch are given the same due time, so that they are
+	// sent together again.
+	countURLFailure(entry.url)
+	due := time.Now().Add(max(retryDelay(config.GlobalSettings().RetryLimit-entry.retry), retryAfter))
+	for _, failed := range entries {
+		r.retry(failed, due)
+	}
+}
+
+// requeue puts back an entry that has not been sent.
+func (r *Reporter) requeue(entry *PriorityEntry) {
+	if err := Rqueue.offer(entry); err != nil {
+		r.count(&r.counters.ignored)
+		Rqueue.store.remove(entry)
+	}
+}
+
+// postpone reschedules an entry that was held back by an open circuit,
+// without consuming one of its retries.
+func (r *Reporter) postpone(entry *PriorityEntry, due time.Time) {
+	entry.due = due
+	if err := Rqueue.offer(entry); err != nil {
+		r.count(&r.counters.ignored)
+		Rqueue.store.remove(entry)
 	} else {
-		r.counters.failure++
-		if entry.retry > 0 {
-			backoff := time.Duration(math.Pow(2, float64(RetryLimit-entry.retry))) * time.Second
-			entry.due = entry.due.Add(backoff)
-			entry.retry--
-			err = Rqueue.queue.Offer(entry)
-			if err != nil {
-				r.counters.ignored++
-			}
+		Rqueue.store.update(entry)
+	}
+}
+
+// retry re-offers a failed entry to be sent at due, after a jittered
+// exponential backoff or the server's Retry-After if it asks for a longer
+// one, or drops it once its retries are exhausted.
+func (r *Reporter) retry(entry *PriorityEntry, due time.Time) {
+	r.count(&r.counters.failure)
+	if entry.retry > 0 {
+		entry.due = due
+		entry.retry--
+		err := Rqueue.offer(entry)
+		if err != nil {
+			r.count(&r.counters.ignored)
+			Rqueue.store.remove(entry)
 		} else {
-			r.counters.ignored++
+			Rqueue.store.update(entry)
 		}
+	} else {
+		r.count(&r.counters.ignored)
+		Rqueue.store.remove(entry)
 	}
 }
 
 func (r *Reporter) Run() {
 	for {
-		Rqueue.cond.L.Lock()
-		for Rqueue.queue.Size() == 0 {
-			Rqueue.cond.Wait()
+		head := Rqueue.next()
+		if head == nil {
+			return
 		}
-		entry, err := Rqueue.queue.Get()
-		Rqueue.cond.L.Unlock()
-		if err != nil {
-			continue
+
+		entries := []*PriorityEntry{head}
+		if limit := batchLimit(head); limit > 1 {
+			entries = Rqueue.takeBatch(head, limit)
 		}
 
-		if !entry.expiry.IsZero() && entry.expiry.Before(time.Now()) {
-			r.counters.ignored++
-		} else if !entry.due.IsZero() && entry.due.After(time.Now()) {
-			err = Rqueue.queue.Offer(entry)
-			if err != nil {
-				r.counters.ignored++
+		var live []*PriorityEntry
+		for _, entry := range entries {
+			if !entry.expiry.IsZero() && entry.expiry.Before(time.Now()) {
+				log.Debug().Msgf("Dropping expired entry: %s %s", entry.method, entry.url)
+				r.count(&r.counters.expired)
+				Rqueue.store.remove(entry)
+			} else {
+				live = append(live, entry)
 			}
-			time.Sleep(1 * time.Second)
-		} else {
-			r.query(entry)
 		}
+
+		if len(live) > 0 {
+			r.query(live)
+		}
+		Rqueue.done()
+	}
+}
+
+// count increments one of the reporter's counters.
+func (r *Reporter) count(counter *int) {
+	r.counters.mu.Lock()
+	*counter++
+	r.counters.mu.Unlock()
+}
+
+func (r *Reporter) snapshot() ReporterCounters {
+	r.counters.mu.Lock()
+	defer r.counters.mu.Unlock()
+
+	return ReporterCounters{
+		Name:    r.name,
+		Success: r.counters.success,
+		Failure: r.counters.failure,
+		Ignored: r.counters.ignored,
+		Expired: r.counters.expired,
+		Delay:   r.counters.delay,
+		Latency: r.counters.latency,
 	}
 }
 
-// TODO : GetReporterStats
-func GetReporterStats() {}
+func countURLFailure(url string) {
+	endpoint := endpointPattern(url)
+
+	urlFailuresMu.Lock()
+	defer urlFailuresMu.Unlock()
+
+	if _, ok := urlFailures[endpoint]; !ok && len(urlFailures) >= maxURLFailures {
+		endpoint = otherEndpoint
+	}
+	urlFailures[endpoint]++
+}
+
+// endpointPattern returns the path of url with the query dropped and the
+// IDs in it replaced by {id}, so that the fins of different commands, for
+// instance, are counted as a single endpoint.
+func endpointPattern(url string) string {
+	path, _, _ := strings.Cut(url, "?")
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseUint(segment, 10, 64); err == nil {
+			segments[i] = "{id}"
+		} else if _, err = uuid.Parse(segment); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// GetReporterStats aggregates the counters of every reporter together with
+// the state of the request queue. It is safe to call from any goroutine.
+func GetReporterStats() ReporterStats {
+	stats := ReporterStats{
+		Reporters:   []ReporterCounters{},
+		URLFailures: make(map[string]int),
+	}
+
+	reportersMu.RLock()
+	for _, reporter := range reporters {
+		counters := reporter.snapshot()
+		stats.Reporters = append(stats.Reporters, counters)
+		stats.Success += counters.Success
+		stats.Failure += counters.Failure
+		stats.Ignored += counters.Ignored
+		stats.Expired += counters.Expired
+		stats.Delay += counters.Delay
+		stats.Latency += counters.Latency
+	}
+	reportersMu.RUnlock()
+
+	if n := len(stats.Reporters); n > 0 {
+		stats.Delay /= float64(n)
+		stats.Latency /= float64(n)
+	}
+
+	urlFailuresMu.Lock()
+	for url, count := range urlFailures {
+		stats.URLFailures[url] = count
+	}
+	urlFailuresMu.Unlock()
+
+	if Rqueue != nil {
+		stats.Evicted = Rqueue.evictions()
+		stats.Coalesced = Rqueue.coalesced()
+		stats.OpenCircuits = openCircuits(time.Now())
+		stats.QueueSize = Rqueue.size()
+		if oldestDue := Rqueue.oldestDue(); !oldestDue.IsZero() {
+			stats.OldestDue = &oldestDue
+		}
+	}
+
+	return stats
+}
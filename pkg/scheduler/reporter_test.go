@@ -0,0 +1,83 @@
+package scheduler
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndpointPattern(t *testing.T) {
+	id := uuid.NewString()
+	assert.Equal(t, "/api/events/commands/{id}/fin/", endpointPattern("/api/events/commands/"+id+"/fin/"))
+	assert.Equal(t, "/api/proc/{id}/", endpointPattern("/api/proc/42/?page=2"))
+	assert.Equal(t, "/api/history/logs/", endpointPattern("/api/history/logs/"))
+}
+
+func TestGetReporterStats(t *testing.T) {
+	var flaky atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/flaky/":
+			if flaky.Add(1) == 1 {
+				w.WriteHeader(http.StatusRequestTimeout)
+			}
+		case strings.HasPrefix(r.URL.Path, "/api/events/commands/ok"):
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	queue := Rqueue
+	Rqueue = newTestQueue(10)
+	reporter := &Reporter{name: "Reporter-0", session: newTestSession(server.URL, 0), counters: &counters{}}
+	reportersMu.Lock()
+	previous := reporters
+	reporters = []*Reporter{reporter}
+	reportersMu.Unlock()
+	urlFailuresMu.Lock()
+	urlFailures = make(map[string]int)
+	urlFailuresMu.Unlock()
+	t.Cleanup(func() {
+		Rqueue = queue
+		reportersMu.Lock()
+		reporters = previous
+		reportersMu.Unlock()
+	})
+
+	now := time.Now()
+	for _, url := range []string{
+		"/api/events/commands/ok/fin/",
+		"/api/events/commands/" + uuid.NewString() + "/fin/",
+		"/api/events/commands/" + uuid.NewString() + "/fin/",
+		"/api/flaky/",
+	} {
+		require.NoError(t, Rqueue.offer(&PriorityEntry{method: "POST", url: url, data: `{}`, priority: 10, due: now, retry: 5}))
+	}
+	for Rqueue.size() > 0 {
+		Rqueue.mu.Lock()
+		for _, entry := range Rqueue.waiting {
+			entry.due = now
+		}
+		Rqueue.mu.Unlock()
+		reporter.query([]*PriorityEntry{Rqueue.next()})
+	}
+
+	stats := GetReporterStats()
+	require.Len(t, stats.Reporters, 1)
+	assert.Equal(t, "Reporter-0", stats.Reporters[0].Name)
+	assert.Equal(t, 2, stats.Success, "The retried entry should be counted once delivered.")
+	assert.Equal(t, 3, stats.Failure)
+	assert.Equal(t, 2, stats.Ignored, "Rejected entries should be dropped.")
+	assert.Equal(t, 0, stats.QueueSize)
+	assert.Equal(t, map[string]int{
+		"/api/events/commands/{id}/fin/": 2,
+		"/api/flaky/":                    1,
+	}, stats.URLFailures, "Failures should be counted by endpoint, not by command.")
+}
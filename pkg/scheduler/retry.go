@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	baseRetryDelay = 1 * time.Second
+	maxRetryDelay  = 5 * time.Minute
+	// maxRetryShift is well past maxRetryDelay and keeps the shift from overflowing.
+	maxRetryShift = 16
+)
+
+// isPermanentFailure reports whether retrying a request answered with
+// statusCode is pointless. Client errors will fail again the same way, except
+// for timeouts and rate limiting, which are worth retrying later.
+func isPermanentFailure(statusCode int) bool {
+	if statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return statusCode/100 == 4
+}
+
+// isOverloaded reports whether statusCode means the server asks clients to back off.
+func isOverloaded(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode/100 == 5
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as
+// an HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return min(time.Duration(seconds)*time.Second, maxRetryDelay)
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return min(date.Sub(now), maxRetryDelay)
+	}
+
+	return 0
+}
+
+// retryDelay returns the exponential backoff for the given attempt (0 for
+// the first retry) with equal jitter, so that entries failing together do
+// not come back together.
+func retryDelay(attempt int) time.Duration {
+	delay := min(baseRetryDelay<<min(max(attempt, 0), maxRetryShift), maxRetryDelay)
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
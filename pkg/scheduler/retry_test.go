@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsPermanentFailure(t *testing.T) {
+	assert.True(t, isPermanentFailure(http.StatusBadRequest))
+	assert.True(t, isPermanentFailure(http.StatusNotFound))
+	assert.False(t, isPermanentFailure(http.StatusRequestTimeout))
+	assert.False(t, isPermanentFailure(http.StatusTooManyRequests))
+	assert.False(t, isPermanentFailure(http.StatusServiceUnavailable))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, maxRetryDelay, parseRetryAfter("86400", now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+}
+
+func TestRetryDelayIsJittered(t *testing.T) {
+	for attempt := 0; attempt < 5; attempt++ {
+		delay := retryDelay(attempt)
+		full := baseRetryDelay << attempt
+		assert.GreaterOrEqual(t, delay, full/2)
+		assert.LessOrEqual(t, delay, full)
+	}
+
+	assert.LessOrEqual(t, retryDelay(100), maxRetryDelay, "Large attempts should not overflow.")
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	cb := &circuitBreaker{}
+	now := time.Now()
+
+	for i := 0; i < breakerThreshold; i++ {
+		_, ok := cb.allow(now)
+		assert.True(t, ok)
+		cb.failure(now, 0)
+	}
+
+	retryAt, ok := cb.allow(now)
+	assert.False(t, ok, "Circuit should be open after consecutive failures.")
+	assert.Equal(t, now.Add(minBreakerCooldown), retryAt)
+
+	later := retryAt.Add(time.Millisecond)
+	_, ok = cb.allow(later)
+	assert.True(t, ok, "A single probe should be let through after the cooldown.")
+	_, ok = cb.allow(later)
+	assert.False(t, ok, "Only one probe should be in flight.")
+
+	cb.success()
+	_, ok = cb.allow(later)
+	assert.True(t, ok)
+}
+
+func TestCircuitBreakerHonorsRetryAfter(t *testing.T) {
+	cb := &circuitBreaker{}
+	now := time.Now()
+
+	cb.failure(now, time.Minute)
+	retryAt, ok := cb.allow(now)
+	assert.False(t, ok)
+	assert.Equal(t, now.Add(time.Minute), retryAt)
+}
@@ -2,17 +2,16 @@ package scheduler
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alpacanetworks/alpamon-go/pkg/config"
 	"github.com/alpacanetworks/alpamon-go/pkg/utils"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
-	"os"
-	"strings"
 	"time"
 )
 
@@ -21,106 +20,290 @@ const (
 )
 
 func InitSession() *Session {
+	settings := config.GlobalSettings()
 	session := &Session{
-		BaseURL: config.GlobalSettings.ServerURL,
+		transport: &reloadableTransport{},
 	}
 
 	client := http.Client{}
 
-	tlsConfig := &tls.Config{}
-	if config.GlobalSettings.CaCert != "" {
-		caCertPool := x509.NewCertPool()
-		caCert, err := os.ReadFile(config.GlobalSettings.CaCert)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to read CA certificate")
-		}
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
-	}
-
-	tlsConfig.InsecureSkipVerify = config.GlobalSettings.SSLVerify
-	client.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up TLS")
 	}
+	clientTLSConfig.Store(tlsConfig)
+	session.transport.current.Store(NewTransport())
+	client.Transport = session.transport
 
 	session.Client = &client
-	session.authorization = fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)
+	session.SetBaseURL(settings.ServerURL)
+	session.SetCredentials(settings.ID, settings.Key)
+	session.gzipMinSize.Store(int64(settings.GzipMinSize))
 
 	return session
 }
 
+// BaseURL returns the URL of Alpacon that request paths are relative to.
+func (session *Session) BaseURL() string {
+	return *session.baseURL.Load()
+}
+
+// SetBaseURL replaces the URL of Alpacon that request paths are relative to.
+func (session *Session) SetBaseURL(url string) {
+	session.baseURL.Store(&url)
+}
+
+// SetCredentials replaces the server ID and key sent with every request.
+func (session *Session) SetCredentials(id, key string) {
+	authorization := fmt.Sprintf(`id="%s", key="%s"`, id, key)
+	session.authorization.Store(&authorization)
+}
+
 func (session *Session) CheckSession() bool {
-	timeout := config.MinConnectInterval
+	settings := config.GlobalSettings()
+	timeout := settings.MinConnectInterval
 
 	for {
-		resp, _, err := session.Get(checkSessionURL, 5)
+		resp, _, err := session.Get(checkSessionURL, requestTimeout())
 		if err != nil {
-			log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds", config.GlobalSettings.ServerURL, int(timeout.Seconds()))
+			log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds", settings.ServerURL, int(timeout.Seconds()))
 			time.Sleep(timeout)
 			timeout *= 2
-			if timeout > config.MaxConnectInterval {
-				timeout = config.MaxConnectInterval
+			if timeout > settings.MaxConnectInterval {
+				timeout = settings.MaxConnectInterval
 			}
 			continue
 		}
 
-		var response map[string]interface{}
-		err = json.Unmarshal(resp, &response)
+		commissioned, err := parseCommissioned(resp)
 		if err != nil {
-			log.Debug().Err(err).Msg("Failed to unmarshal JSON")
+			log.Error().Err(err).Msg("Unexpected response to the session check")
 			continue
 		}
+		return commissioned
+	}
+}
 
-		if commissioned, ok := response["commissioned"].(bool); ok {
-			return commissioned
-		} else {
-			log.Error().Msg("Unable to find 'commissioned' field in the response")
-			continue
-		}
+// CheckCredentials makes a single session check with the given credentials,
+// without changing the ones in use. It returns an error if Alpacon rejects them.
+func (session *Session) CheckCredentials(id, key string) error {
+	req, err := session.newRequest(http.MethodGet, checkSessionURL, nil)
+	if err != nil {
+		return err
+	}
+
+	candidate := &Session{Client: session.Client}
+	candidate.SetBaseURL(session.BaseURL())
+	candidate.SetCredentials(id, key)
+	resp, statusCode, err := candidate.do(req, requestTimeout())
+	if err != nil {
+		return err
+	}
+	if !utils.IsSuccessStatusCode(statusCode) {
+		return fmt.Errorf("session check failed with status %d", statusCode)
+	}
+
+	_, err = parseCommissioned(resp)
+	return err
+}
+
+// requestTimeout returns the configured timeout for requests to Alpacon.
+func requestTimeout() time.Duration {
+	return config.GlobalSettings().RequestTimeout
+}
+
+func parseCommissioned(resp []byte) (bool, error) {
+	var response map[string]interface{}
+	err := json.Unmarshal(resp, &response)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal JSON: %w", err)
 	}
+
+	commissioned, ok := response["commissioned"].(bool)
+	if !ok {
+		return false, errors.New("unable to find 'commissioned' field in the response")
+	}
+	return commissioned, nil
 }
 
 func (session *Session) newRequest(method, url string, rawBody interface{}) (*http.Request, error) {
-	var body io.Reader
-	if rawBody != nil {
-		switch v := rawBody.(type) {
-		case string:
-			body = strings.NewReader(v)
-		case []byte:
-			body = bytes.NewReader(v)
-		default:
-			jsonBody, err := json.Marshal(rawBody)
-			if err != nil {
-				return nil, err
-			}
-			body = bytes.NewReader(jsonBody)
+	req, err := http.NewRequest(method, utils.JoinPath(session.BaseURL(), url), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rawBody == nil {
+		return req, nil
+	}
+
+	var data []byte
+	switch v := rawBody.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		data, err = json.Marshal(rawBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if session.shouldCompress(req.URL.Host, data) {
+		data, err = gzipBody(data)
+		if err != nil {
+			return nil, err
 		}
+		req.Header.Set("Content-Encoding", "gzip")
 	}
+	setBody(req, data)
 
-	return http.NewRequest(method, utils.JoinPath(session.BaseURL, url), body)
+	return req, nil
+}
+
+func (session *Session) shouldCompress(host string, data []byte) bool {
+	minSize := session.gzipMinSize.Load()
+	if minSize <= 0 || int64(len(data)) < minSize {
+		return false
+	}
+	_, rejected := session.gzipRejected.Load(host)
+	return !rejected
+}
+
+func gzipBody(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setBody makes data the body of req, replayable for redirects and retries.
+func setBody(req *http.Request, data []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// uncompressed returns a copy of a gzipped request with its original body,
+// bound to ctx instead of the context of req.
+func uncompressed(ctx context.Context, req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("request body of %s cannot be replayed", req.URL)
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := req.Clone(ctx)
+	plain.Header.Del("Content-Encoding")
+	setBody(plain, data)
+	return plain, nil
+}
+
+// isGzipRejection reports whether the server answered that it could not
+// decode a gzipped body: with 415, or with a 400 whose body blames the
+// encoding. Any other 400 is a genuine validation error, which sending the
+// body again uncompressed would only repeat.
+func isGzipRejection(statusCode int, body []byte) bool {
+	if statusCode == http.StatusUnsupportedMediaType {
+		return true
+	}
+	if statusCode != http.StatusBadRequest {
+		return false
+	}
+	text := bytes.ToLower(body)
+	return bytes.Contains(text, []byte("gzip")) || bytes.Contains(text, []byte("encoding"))
+}
+
+// withTimeout bounds req, including reading its response, by timeout. Like
+// http.Client.Timeout, zero means no timeout.
+func withTimeout(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
 }
 
 func (session *Session) do(req *http.Request, timeout time.Duration) ([]byte, int, error) {
-	session.Client.Timeout = timeout * time.Second
-	req.Header.Set("Authorization", session.authorization)
+	body, statusCode, _, err := session.send(req, timeout)
+	return body, statusCode, err
+}
+
+// send is like do, but also returns the response headers for callers that
+// need them, e.g. to honor Retry-After.
+func (session *Session) send(req *http.Request, timeout time.Duration) ([]byte, int, http.Header, error) {
+	// The client is shared by every reporter, so the timeout is set per
+	// request rather than on the client.
+	parent := req.Context()
+	req, cancel := withTimeout(req, timeout)
+	defer cancel()
+
+	req.Header.Set("Authorization", *session.authorization.Load())
 
 	if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	// Accept-Encoding is left to the transport, which then asks for gzipped
+	// responses and decompresses them transparently.
 	resp, err := session.Client.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, nil, err
 	}
 
 	defer func() { _ = resp.Body.Close() }()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, resp.StatusCode, err
+		return nil, resp.StatusCode, resp.Header, err
+	}
+
+	if req.Header.Get("Content-Encoding") == "gzip" && isGzipRejection(resp.StatusCode, body) {
+		// The plain request gets a timeout of its own rather than what is
+		// left of this one.
+		return session.resendUncompressed(parent, req, timeout, body, resp.StatusCode, resp.Header)
+	}
+
+	return body, resp.StatusCode, resp.Header, nil
+}
+
+// resendUncompressed retries a gzipped request that the server turned down
+// with its plain body. Compression is switched off for the host only if the
+// plain request is accepted, so that a 400 mentioning the encoding for
+// another reason does not disable it.
+func (session *Session) resendUncompressed(ctx context.Context, req *http.Request, timeout time.Duration, body []byte, statusCode int, header http.Header) ([]byte, int, http.Header, error) {
+	plain, err := uncompressed(ctx, req)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to restore the uncompressed request body")
+		return body, statusCode, header, nil
 	}
 
-	return body, resp.StatusCode, nil
+	plainBody, plainStatusCode, plainHeader, err := session.send(plain, timeout)
+	if err == nil && !isGzipRejection(plainStatusCode, plainBody) {
+		if _, rejected := session.gzipRejected.LoadOrStore(req.URL.Host, true); !rejected {
+			log.Warn().Msgf("%s rejected a gzipped request body (%d), sending requests to it uncompressed from now on", req.URL.Host, statusCode)
+		}
+	}
+
+	return plainBody, plainStatusCode, plainHeader, err
 }
 
 func (session *Session) Request(method, url string, rawBody interface{}, timeout time.Duration) ([]byte, int, error) {
@@ -152,8 +335,10 @@ func (session *Session) MultipartRequest(url string, body bytes.Buffer, contentT
 		return nil, 0, err
 	}
 
-	session.Client.Timeout = timeout * time.Second
-	req.Header.Set("Authorization", session.authorization)
+	req, cancel := withTimeout(req, timeout)
+	defer cancel()
+
+	req.Header.Set("Authorization", *session.authorization.Load())
 	req.Header.Set("Content-Type", contentType)
 
 	resp, err := session.Client.Do(req)
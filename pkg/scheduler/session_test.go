@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSession(url string, gzipMinSize int) *Session {
+	session := &Session{Client: &http.Client{}}
+	session.SetBaseURL(url)
+	session.SetCredentials("id", "key")
+	session.gzipMinSize.Store(int64(gzipMinSize))
+	return session
+}
+
+func gzipRejected(session *Session, serverURL string) bool {
+	_, rejected := session.gzipRejected.Load(strings.TrimPrefix(serverURL, "http://"))
+	return rejected
+}
+
+func TestLargeBodyIsGzipped(t *testing.T) {
+	payload := strings.Repeat("a", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		reader, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(reader)
+		assert.Equal(t, payload, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 10)
+	_, statusCode, err := session.Request(http.MethodPost, "/", payload, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.False(t, gzipRejected(session, server.URL))
+}
+
+func TestRejectedGzipFallsBackToPlainBody(t *testing.T) {
+	payload := strings.Repeat("a", 100)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, payload, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 10)
+	_, statusCode, err := session.Request(http.MethodPost, "/", payload, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.True(t, gzipRejected(session, server.URL), "The host should be remembered to turn down gzip.")
+
+	_, statusCode, err = session.Request(http.MethodPost, "/", payload, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, 3, requests)
+}
+
+func TestValidationErrorIsNotResentUncompressed(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"level":["This field is required."]}`))
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 10)
+	_, statusCode, err := session.Request(http.MethodPost, "/", strings.Repeat("a", 100), 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, 1, requests, "Only a rejection of the encoding should be retried.")
+	assert.False(t, gzipRejected(session, server.URL))
+}
+
+func TestUncompressedRetryHasItsOwnTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"detail":"Unsupported content encoding."}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 10)
+	_, statusCode, err := session.Request(http.MethodPost, "/", strings.Repeat("a", 100), 500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+}
+
+func TestCheckCredentialsDoesNotSwapKey(t *testing.T) {
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != `id="id", key="new"` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"commissioned": true}`))
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 0)
+	assert.Error(t, session.CheckCredentials("id", "wrong"))
+	assert.NoError(t, session.CheckCredentials("id", "new"))
+
+	_, statusCode, err := session.Get("/", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+	assert.Equal(t, `id="id", key="key"`, authorizations[len(authorizations)-1])
+}
+
+func TestSubSecondTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	session := newTestSession(server.URL, 0)
+	start := time.Now()
+	_, _, err := session.Get("/", 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second, "Timeouts below a second should not be truncated.")
+}
@@ -0,0 +1,295 @@
+package scheduler
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	queueDBDir      = "/var/lib/alpamon"
+	queueDBFileName = "queue.db"
+
+	// compactInterval is the number of removed entries after which up to
+	// compactPages free pages of the journal are given back to the filesystem.
+	// Freeing them a few at a time keeps the single connection from being
+	// held for long while reporters are waiting on it.
+	compactInterval = 1000
+	compactPages    = 256
+)
+
+// queueMigrations are applied in order, tracked by PRAGMA user_version.
+// Never edit an existing statement; append a new one instead.
+var queueMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS entries (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		priority INTEGER NOT NULL,
+		method   TEXT    NOT NULL,
+		url      TEXT    NOT NULL,
+		data     BLOB,
+		due      INTEGER NOT NULL,
+		expiry   INTEGER NOT NULL,
+		retry    INTEGER NOT NULL
+	)`,
+	`ALTER TABLE entries ADD COLUMN key TEXT NOT NULL DEFAULT ''`,
+	// Switching to incremental auto-vacuum only takes effect after a full
+	// vacuum, which is done once here, while the journal is being opened.
+	`PRAGMA auto_vacuum = INCREMENTAL; VACUUM`,
+	`ALTER TABLE entries ADD COLUMN batch TEXT NOT NULL DEFAULT ''`,
+}
+
+// queueStore journals queued requests to an SQLite database so that they
+// survive restarts, crashes and reboots while Alpacon is unreachable.
+// A nil *queueStore is valid and turns every operation into a no-op.
+type queueStore struct {
+	db      *sql.DB
+	path    string
+	mu      sync.Mutex
+	removed int
+}
+
+func openQueueStore() (*queueStore, error) {
+	path := filepath.Join(queueDBDir, queueDBFileName)
+	if _, err := os.Stat(queueDBDir); os.IsNotExist(err) {
+		path = queueDBFileName
+	}
+
+	return openStore(path)
+}
+
+// openStore opens the journal at path, creating and migrating it as needed.
+func openStore(path string) (*queueStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serializing access avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+	} {
+		if _, err = db.Exec(pragma); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to apply %s: %w", pragma, err)
+		}
+	}
+
+	store := &queueStore{db: db, path: path}
+	if err = store.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *queueStore) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(queueMigrations); i++ {
+		if _, err = s.db.Exec(queueMigrations[i]); err != nil {
+			return fmt.Errorf("failed to migrate queue schema to version %d: %w", i+1, err)
+		}
+		if _, err = s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			return fmt.Errorf("failed to update schema version: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *queueStore) insert(entry *PriorityEntry) error {
+	if s == nil {
+		return nil
+	}
+
+	result, err := s.db.Exec(
+		"INSERT INTO entries (key, batch, priority, method, url, data, due, expiry, retry) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.key, entry.batch, entry.priority, entry.method, entry.url, entry.data,
+		toUnixNano(entry.due), toUnixNano(entry.expiry), entry.retry,
+	)
+	if err != nil {
+		return err
+	}
+
+	entry.id, err = result.LastInsertId()
+	return err
+}
+
+// update persists the scheduling state of an entry that is being retried.
+func (s *queueStore) update(entry *PriorityEntry) {
+	if s == nil || entry.id == 0 {
+		return
+	}
+
+	_, err := s.db.Exec("UPDATE entries SET batch = ?, due = ?, retry = ? WHERE id = ?",
+		entry.batch, toUnixNano(entry.due), entry.retry, entry.id)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to update queued entry %d in %s.", entry.id, s.path)
+	}
+}
+
+// replace persists the new body and scheduling of a coalesced entry.
+func (s *queueStore) replace(entry *PriorityEntry) {
+	if s == nil || entry.id == 0 {
+		return
+	}
+
+	_, err := s.db.Exec("UPDATE entries SET key = ?, priority = ?, data = ?, due = ?, expiry = ?, retry = ? WHERE id = ?",
+		entry.key, entry.priority, entry.data, toUnixNano(entry.due), toUnixNano(entry.expiry), entry.retry, entry.id)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to update queued entry %d in %s.", entry.id, s.path)
+	}
+}
+
+// group persists the batch the entries were sent in, before it is sent.
+func (s *queueStore) group(entries []*PriorityEntry) {
+	if s == nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err == nil {
+		for _, entry := range entries {
+			if entry.id == 0 {
+				continue
+			}
+			if _, err = tx.Exec("UPDATE entries SET batch = ? WHERE id = ?", entry.batch, entry.id); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to record a batch of %d entries in %s.", len(entries), s.path)
+	}
+}
+
+// remove deletes a delivered or discarded entry and periodically compacts the journal.
+func (s *queueStore) remove(entry *PriorityEntry) {
+	if s == nil || entry.id == 0 {
+		return
+	}
+
+	_, err := s.db.Exec("DELETE FROM entries WHERE id = ?", entry.id)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to remove queued entry %d from %s.", entry.id, s.path)
+		return
+	}
+
+	s.mu.Lock()
+	s.removed++
+	compact := s.removed >= compactInterval
+	if compact {
+		s.removed = 0
+	}
+	s.mu.Unlock()
+
+	if compact {
+		s.compact()
+	}
+}
+
+func (s *queueStore) compact() {
+	// The vacuum frees a page for each step, so its rows are read to the end.
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", compactPages))
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		_ = rows.Close()
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to compact %s.", s.path)
+	}
+}
+
+// close checkpoints the write-ahead log into the database and closes it.
+func (s *queueStore) close() {
+	if s == nil {
+		return
+	}
+
+	if _, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Debug().Err(err).Msgf("Failed to checkpoint %s.", s.path)
+	}
+	if err := s.db.Close(); err != nil {
+		log.Debug().Err(err).Msgf("Failed to close %s.", s.path)
+	}
+}
+
+// load returns every journaled entry, oldest first.
+func (s *queueStore) load() ([]*PriorityEntry, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	entries, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries journaled before idempotency keys were introduced get one now,
+	// and keep it from then on.
+	for _, entry := range entries {
+		if entry.key == "" {
+			entry.key = uuid.NewString()
+			s.replace(entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *queueStore) scan() ([]*PriorityEntry, error) {
+	rows, err := s.db.Query("SELECT id, key, batch, priority, method, url, data, due, expiry, retry FROM entries ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var entries []*PriorityEntry
+	for rows.Next() {
+		entry := &PriorityEntry{}
+		var due, expiry int64
+		err = rows.Scan(&entry.id, &entry.key, &entry.batch, &entry.priority, &entry.method, &entry.url, &entry.data, &due, &expiry, &entry.retry)
+		if err != nil {
+			return nil, err
+		}
+		entry.due = fromUnixNano(due)
+		entry.expiry = fromUnixNano(expiry)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,174 @@
+package scheduler
+
+import (
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *queueStore {
+	store, err := openStore(path)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queueDBFileName)
+	store := openTestStore(t, path)
+
+	due := time.Now().Add(time.Minute).Round(0)
+	retried := &PriorityEntry{key: "a", priority: 10, method: "POST", url: "/api/events/commands/1/fin/", data: `{"success":true}`, due: due, retry: 5}
+	coalesced := &PriorityEntry{key: "b", priority: 80, method: "PATCH", url: "/api/proc/info/", data: `{"v":1}`, due: due, retry: 5}
+	delivered := &PriorityEntry{key: "c", priority: 90, method: "POST", url: "/api/history/logs/", data: `{}`, due: due, retry: 5}
+	for _, entry := range []*PriorityEntry{retried, coalesced, delivered} {
+		require.NoError(t, store.insert(entry))
+		assert.NotZero(t, entry.id)
+	}
+
+	retried.due = due.Add(time.Minute)
+	retried.retry = 4
+	retried.batch = "batch"
+	store.update(retried)
+
+	coalesced.key = "d"
+	coalesced.data = `{"v":2}`
+	coalesced.expiry = due.Add(time.Hour)
+	store.replace(coalesced)
+
+	store.remove(delivered)
+	store.close()
+
+	store = openTestStore(t, path)
+	defer store.close()
+	entries, err := store.load()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, retried.id, entries[0].id)
+	assert.Equal(t, "a", entries[0].key)
+	assert.Equal(t, 4, entries[0].retry)
+	assert.Equal(t, "batch", entries[0].batch)
+	assert.True(t, retried.due.Equal(entries[0].due))
+	assert.True(t, entries[0].expiry.IsZero())
+
+	assert.Equal(t, "d", entries[1].key)
+	assert.Equal(t, "PATCH", entries[1].method)
+	assert.Equal(t, `{"v":2}`, entries[1].data)
+	assert.True(t, coalesced.expiry.Equal(entries[1].expiry))
+}
+
+func TestStoreMigratesJournalWithoutKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queueDBFileName)
+
+	// A journal written before idempotency keys were introduced.
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(queueMigrations[0])
+	require.NoError(t, err)
+	_, err = db.Exec("PRAGMA user_version = 1")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO entries (priority, method, url, data, due, expiry, retry) VALUES (90, 'POST', '/api/history/logs/', '{}', 0, 0, 5)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store := openTestStore(t, path)
+	entries, err := store.load()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	key := entries[0].key
+	assert.NotEmpty(t, key, "Entries without a key should be given one.")
+	store.close()
+
+	store = openTestStore(t, path)
+	defer store.close()
+	entries, err = store.load()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, key, entries[0].key, "The key given on migration should be kept.")
+}
+
+func TestReplayCoalescesAndDeliveryRemoves(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), queueDBFileName)
+	store := openTestStore(t, path)
+	now := time.Now()
+	for _, entry := range []*PriorityEntry{
+		{key: "a", priority: 80, method: "PATCH", url: "/api/proc/info/", data: `{"v":1}`, due: now, retry: 5},
+		{key: "b", priority: 90, method: "POST", url: "/api/history/logs/", data: `{}`, due: now, retry: 5},
+		{key: "c", priority: 80, method: "PATCH", url: "/api/proc/info/", data: `{"v":2}`, due: now, retry: 5},
+	} {
+		require.NoError(t, store.insert(entry))
+	}
+	store.close()
+
+	queue := Rqueue
+	Rqueue = newTestQueue(10)
+	Rqueue.store = openTestStore(t, path)
+	defer Rqueue.store.close()
+	t.Cleanup(func() { Rqueue = queue })
+
+	Rqueue.replay()
+	assert.Equal(t, 2, Rqueue.size(), "Writes to the same URL should be coalesced on replay.")
+	entries, err := Rqueue.store.load()
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "Coalesced entries should be removed from the journal.")
+
+	reporter := &Reporter{session: newTestSession(server.URL, 0), counters: &counters{}}
+	for Rqueue.size() > 0 {
+		entry := Rqueue.next()
+		if entry.method == "PATCH" {
+			assert.Equal(t, `{"v":2}`, entry.data, "The latest write should win.")
+			assert.Equal(t, "c", entry.key)
+		}
+		reporter.query([]*PriorityEntry{entry})
+	}
+
+	entries, err = Rqueue.store.load()
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Delivered entries should be removed from the journal.")
+	assert.Equal(t, 2, reporter.snapshot().Success)
+}
+
+func TestStoreCompactsIncrementally(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queueDBFileName)
+	store := openTestStore(t, path)
+	defer store.close()
+
+	var autoVacuum int
+	require.NoError(t, store.db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum))
+	assert.Equal(t, 2, autoVacuum, "The journal should use incremental auto-vacuum.")
+
+	data := strings.Repeat("x", 4096)
+	var entries []*PriorityEntry
+	for i := 0; i < compactInterval; i++ {
+		entry := &PriorityEntry{key: uuid.NewString(), priority: 90, method: "POST", url: "/api/history/logs/", data: data, retry: 5}
+		require.NoError(t, store.insert(entry))
+		entries = append(entries, entry)
+	}
+
+	freePages := func() int {
+		var count int
+		require.NoError(t, store.db.QueryRow("PRAGMA freelist_count").Scan(&count))
+		return count
+	}
+	for _, entry := range entries[:compactInterval-1] {
+		store.remove(entry)
+	}
+	before := freePages()
+	require.Greater(t, before, compactPages)
+
+	store.remove(entries[compactInterval-1])
+	// Removing the last entry frees a page of its own.
+	assert.InDelta(t, compactPages, before-freePages(), 1, "Only a bounded number of pages should be freed at once.")
+}
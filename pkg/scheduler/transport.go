@@ -0,0 +1,230 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/alpacanetworks/alpamon-go/pkg/config"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientTLSConfig is shared by every connection to Alpacon: the REST
+// session, the backhaul and the pty websockets. It is set by InitSession
+// and replaced by ApplySettings.
+var clientTLSConfig atomic.Pointer[tls.Config]
+
+// TLSOptions holds the TLS material used to connect to Alpacon before the
+// settings exist, i.e. when registering the server.
+type TLSOptions struct {
+	Verify     bool     `json:"verify"`
+	Pins       []string `json:"pins,omitempty"`
+	CaCert     []byte   `json:"ca_cert,omitempty"`
+	ClientCert []byte   `json:"client_cert,omitempty"`
+	ClientKey  []byte   `json:"client_key,omitempty"`
+}
+
+// newTLSConfig builds the TLS configuration from the [ssl] settings.
+func newTLSConfig() (*tls.Config, error) {
+	settings := config.GlobalSettings()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !settings.SSLVerify,
+	}
+	if len(settings.Pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyPins(settings.Pins)
+	}
+
+	if settings.CaCert != "" {
+		caCert, err := os.ReadFile(settings.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if settings.ClientCert != "" {
+		reloader := &certReloader{
+			certFile: settings.ClientCert,
+			keyFile:  settings.ClientKey,
+		}
+		if err := reloader.reload(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.getClientCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+// Config builds a TLS configuration out of the options. Unlike the
+// configuration built from the settings, the client certificate is static.
+func (options TLSOptions) Config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !options.Verify,
+	}
+	if len(options.Pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyPins(options.Pins)
+	}
+
+	if len(options.CaCert) > 0 {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(options.CaCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if len(options.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(options.ClientCert, options.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPins returns a certificate check that accepts the connection only
+// if the public key of a certificate in the chain matches one of the pins,
+// the base64-encoded SHA-256 digests of the SubjectPublicKeyInfo. Listing
+// a backup pin for a key that is not in use yet allows rotating the server
+// certificate without locking agents out.
+//
+// Without chain verification, any certificate could be sent along with an
+// untrusted leaf, so only the leaf is matched then.
+func verifyPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var candidates []*x509.Certificate
+		if len(verifiedChains) > 0 {
+			for _, chain := range verifiedChains {
+				candidates = append(candidates, chain...)
+			}
+		} else if len(rawCerts) > 0 {
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, leaf)
+		}
+
+		for _, cert := range candidates {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			pin := base64.StdEncoding.EncodeToString(digest[:])
+			for _, expected := range pins {
+				if subtle.ConstantTimeCompare([]byte(pin), []byte(expected)) == 1 {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("server certificate does not match any of the configured pins")
+	}
+}
+
+// NewTransport returns an HTTP transport for requests to Alpacon.
+func NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientTLSConfig.Load()
+	transport.Proxy = CurrentProxyOptions().ProxyFunc()
+	return transport
+}
+
+// reloadableTransport sends requests through the transport built from the
+// current settings, so that ApplySettings can replace it while requests
+// are in flight.
+type reloadableTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (t *reloadableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(req)
+}
+
+// NewDialer returns a websocket dialer for connections to Alpacon.
+func NewDialer() *websocket.Dialer {
+	return newDialer(clientTLSConfig.Load(), CurrentProxyOptions())
+}
+
+func newDialer(tlsConfig *tls.Config, proxyOptions ProxyOptions) *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	dialer.Proxy = proxyOptions.ProxyFunc()
+	return &dialer
+}
+
+// certReloader serves the client certificate for TLS handshakes, loading
+// it again whenever the certificate or key file changes, so that rotated
+// certificates are used without restarting alpamon.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of both files
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.After(r.modTime) {
+		if err = r.load(modTime); err != nil {
+			// Keep using the previous certificate, the new one may be half written.
+			log.Warn().Err(err).Msgf("Failed to reload client certificate %s.", r.certFile)
+		}
+	}
+
+	return r.cert, nil
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	return r.load(modTime)
+}
+
+// load must be called with r.mu held.
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	if r.cert != nil {
+		log.Info().Msgf("Reloaded client certificate %s.", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
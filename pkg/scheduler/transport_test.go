@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestClientCertificateIsReloadedOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, certFile, keyFile, "old")
+
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	require.NoError(t, reloader.reload())
+
+	commonName := func() string {
+		cert, err := reloader.getClientCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "old", commonName())
+
+	writeTestCertificate(t, certFile, keyFile, "new")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "new", commonName())
+
+	// A broken file keeps the previous certificate in use.
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.Equal(t, "new", commonName())
+}
+
+func TestPinnedServerCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	digest := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	backup := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	get := func(pins ...string) error {
+		tlsConfig, err := TLSOptions{Verify: false, Pins: pins}.Config()
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, get(backup, pin))
+	assert.Error(t, get(backup))
+}
+
+func TestUnverifiedChainIsPinnedByItsLeaf(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	writeTestCertificate(t, certFile, filepath.Join(dir, "ca.key"), "ca")
+	data, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	leaf := server.Certificate()
+
+	digest := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	verify := verifyPins([]string{base64.StdEncoding.EncodeToString(digest[:])})
+
+	assert.NoError(t, verify([][]byte{leaf.Raw, ca.Raw}, [][]*x509.Certificate{{leaf, ca}}),
+		"Any certificate of a verified chain may match.")
+	assert.Error(t, verify([][]byte{leaf.Raw, ca.Raw}, nil),
+		"Without verification, certificates sent along with the leaf should not count.")
+}
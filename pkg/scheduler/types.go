@@ -1,32 +1,54 @@
 package scheduler
 
 import (
-	"github.com/adrianbrad/queue"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Session struct {
-	BaseURL       string
 	Client        *http.Client
-	authorization string
+	transport     *reloadableTransport   // nil if Client was set up by the caller
+	baseURL       atomic.Pointer[string] // swapped when the config is reloaded
+	authorization atomic.Pointer[string] // swapped when the key is rotated
+	gzipMinSize   atomic.Int64           // smallest body sent gzipped, 0 if compression is off
+	gzipRejected  sync.Map               // hosts that turned down a gzipped body
 }
 
 // queue //
 type PriorityEntry struct {
+	id       int64  // row id in the queue journal, 0 if not journaled
+	index    int    // position in the heap holding the entry
+	key      string // idempotency key, stable across retries and restarts
+	batch    string // idempotency key of the batch it was sent in, if any
 	priority int
 	method   string
 	url      string
-	data     interface{}
+	data     string // encoded request body, empty if there is none
 	due      time.Time
 	expiry   time.Time
 	retry    int
+	alone    bool // sent by itself after a batch holding it was rejected
 }
 
 type RequestQueue struct {
-	queue *queue.Priority[PriorityEntry]
-	cond  *sync.Cond
+	mu       sync.Mutex
+	cond     *sync.Cond
+	waiting  dueHeap   // entries whose due time is in the future
+	ready    readyHeap // entries that can be sent right away
+	timer    *time.Timer
+	timerAt  time.Time                 // when timer fires, zero if it is not armed
+	pending  map[string]*PriorityEntry // queued writes by coalesceKey
+	capacity int
+	store    *queueStore
+	inflight int  // entries handed to reporters and not done yet
+	closed   bool // set on shutdown, reporters stop picking up entries
+
+	evicted      int // evictions not yet reported to Alpacon
+	evictedTotal int
+
+	coalescedTotal int
 }
 
 // reporter //
@@ -37,9 +59,39 @@ type Reporter struct {
 }
 
 type counters struct {
+	mu      sync.Mutex
 	success int
 	failure int
 	ignored int
+	expired int
 	delay   float64
 	latency float64
 }
+
+// stats //
+type ReporterStats struct {
+	Reporters   []ReporterCounters `json:"reporters"`
+	Success     int                `json:"success"`
+	Failure     int                `json:"failure"`
+	Ignored     int                `json:"ignored"`
+	Expired     int                `json:"expired"`
+	Delay       float64            `json:"delay"`   // average of the reporters' EWMA delay in seconds
+	Latency     float64            `json:"latency"` // average of the reporters' EWMA latency in seconds
+	Evicted     int                `json:"evicted"`
+	Coalesced   int                `json:"coalesced"`
+	QueueSize   int                `json:"queue_size"`
+	OldestDue   *time.Time         `json:"oldest_due,omitempty"`
+	URLFailures map[string]int     `json:"url_failures"`
+	// OpenCircuits maps hosts that reporters are backing off from to when they will be probed again.
+	OpenCircuits map[string]time.Time `json:"open_circuits,omitempty"`
+}
+
+type ReporterCounters struct {
+	Name    string  `json:"name"`
+	Success int     `json:"success"`
+	Failure int     `json:"failure"`
+	Ignored int     `json:"ignored"`
+	Expired int     `json:"expired"`
+	Delay   float64 `json:"delay"`
+	Latency float64 `json:"latency"`
+}
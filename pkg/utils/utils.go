@@ -8,6 +8,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/shirou/gopsutil/v4/host"
@@ -106,3 +108,20 @@ func ConvertGroupIds(groupIds []string) []uint32 {
 	}
 	return gids
 }
+
+// WaitTimeout waits for wg, giving up after timeout. It reports whether
+// wg was done in time.
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}